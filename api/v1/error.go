@@ -2,8 +2,10 @@ package log_v1
 
 import (
 	"fmt"
+	"strconv"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -32,3 +34,466 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrNotEnoughReplicas is returned to ACKS_ALL producers when fewer replicas
+// than required are in sync. Producers can retry once followers catch up.
+type ErrNotEnoughReplicas struct {
+	Required int
+	InSync   int
+}
+
+func (e ErrNotEnoughReplicas) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.Unavailable,
+		fmt.Sprintf("Not enough in-sync replicas: %d of %d", e.InSync, e.Required),
+	)
+	msg := fmt.Sprintf(
+		"The record needs %d in-sync replicas but only %d are in sync, retry later",
+		e.Required,
+		e.InSync,
+	)
+	d := &errdetails.LocalizedMessage{
+		Message: msg,
+		Locale:  "en-US",
+	}
+	statusDetails, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return statusDetails
+}
+
+func (e ErrNotEnoughReplicas) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotEnoughZones is returned to ACKS_ALL producers when the in-sync
+// replicas span fewer zones than required, so losing one zone could lose
+// the record. Producers can retry once replicas in other zones catch up.
+type ErrNotEnoughZones struct {
+	Required int
+	InSync   int
+}
+
+func (e ErrNotEnoughZones) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.Unavailable,
+		fmt.Sprintf("Not enough in-sync zones: %d of %d", e.InSync, e.Required),
+	)
+	msg := fmt.Sprintf(
+		"The record needs replicas in %d zones but only %d zones are in sync, retry later",
+		e.Required,
+		e.InSync,
+	)
+	d := &errdetails.LocalizedMessage{
+		Message: msg,
+		Locale:  "en-US",
+	}
+	statusDetails, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return statusDetails
+}
+
+func (e ErrNotEnoughZones) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnconfirmed is returned to ACKS_ALL producers when the record was
+// appended but the replicas didn't confirm holding it. Unlike
+// ErrNotEnoughReplicas the record is in the log, so a retry appends it
+// again unless the producer is idempotent.
+type ErrUnconfirmed struct {
+	Offset uint64
+	Reason string
+}
+
+func (e ErrUnconfirmed) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.DeadlineExceeded,
+		fmt.Sprintf("Appended at offset %d but replication is unconfirmed", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record was appended at offset %d but the replicas didn't confirm it: %s. "+
+			"Retrying appends it again unless the producer is idempotent",
+		e.Offset,
+		e.Reason,
+	)
+	d := &errdetails.LocalizedMessage{
+		Message: msg,
+		Locale:  "en-US",
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: "REPLICATION_UNCONFIRMED",
+		Domain: "log.v1",
+		Metadata: map[string]string{
+			"offset": strconv.FormatUint(e.Offset, 10),
+		},
+	}
+	statusDetails, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return statusDetails
+}
+
+func (e ErrUnconfirmed) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrOutOfOrderSequence is returned when an idempotent producer skips a
+// sequence number, or retries one too old for the log to remember.
+type ErrOutOfOrderSequence struct {
+	ProducerId uint64
+	Sequence   uint64
+	Expected   uint64
+}
+
+func (e ErrOutOfOrderSequence) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("Out of order sequence: %d", e.Sequence),
+	)
+	msg := fmt.Sprintf(
+		"Producer %d sent sequence %d but the log expected %d",
+		e.ProducerId,
+		e.Sequence,
+		e.Expected,
+	)
+	d := &errdetails.LocalizedMessage{
+		Message: msg,
+		Locale:  "en-US",
+	}
+	statusDetails, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return statusDetails
+}
+
+func (e ErrOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTxnNotOpen is returned when adding to or ending a transaction that
+// was never begun, already ended or timed out.
+type ErrTxnNotOpen struct {
+	TxnId uint64
+}
+
+func (e ErrTxnNotOpen) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("Transaction not open: %d", e.TxnId),
+	)
+	msg := fmt.Sprintf(
+		"The transaction %d was never begun, already ended or timed out",
+		e.TxnId,
+	)
+	d := &errdetails.LocalizedMessage{
+		Message: msg,
+		Locale:  "en-US",
+	}
+	statusDetails, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return statusDetails
+}
+
+func (e ErrTxnNotOpen) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnexpectedOffset is returned when a conditional append finds the log's
+// next offset isn't the one the producer expected.
+type ErrUnexpectedOffset struct {
+	Expected uint64
+	Actual   uint64
+}
+
+func (e ErrUnexpectedOffset) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("Unexpected offset: %d", e.Expected),
+	)
+	msg := fmt.Sprintf(
+		"The record was expected at offset %d but the log's next offset is %d",
+		e.Expected,
+		e.Actual,
+	)
+	d := &errdetails.LocalizedMessage{
+		Message: msg,
+		Locale:  "en-US",
+	}
+	// the actual offset is also sent machine readable so writers can
+	// reload and retry without parsing the message
+	info := &errdetails.ErrorInfo{
+		Reason: "UNEXPECTED_OFFSET",
+		Domain: "log.v1",
+		Metadata: map[string]string{
+			"expected_offset": strconv.FormatUint(e.Expected, 10),
+			"actual_offset":   strconv.FormatUint(e.Actual, 10),
+		},
+	}
+	statusDetails, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return statusDetails
+}
+
+func (e ErrUnexpectedOffset) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrDiverged is returned when a replica is sent a record for an offset it
+// already holds a different record at, so its log and the one it
+// replicates from diverged.
+type ErrDiverged struct {
+	Offset uint64
+}
+
+func (e ErrDiverged) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("Diverged at offset %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The log holds a different record at offset %d than the log it replicates from",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Message: msg,
+		Locale:  "en-US",
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: "DIVERGED",
+		Domain: "log.v1",
+		Metadata: map[string]string{
+			"offset": strconv.FormatUint(e.Offset, 10),
+		},
+	}
+	statusDetails, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return statusDetails
+}
+
+func (e ErrDiverged) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotLeader is returned when a write reaches a server that isn't the
+// cluster's leader. It names the leader so writers can retry there.
+type ErrNotLeader struct {
+	Leader string
+	Addr   string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("Not the leader, the leader is %q", e.Leader),
+	)
+	msg := fmt.Sprintf(
+		"Only the leader accepts writes, retry on %s at %s",
+		e.Leader,
+		e.Addr,
+	)
+	if e.Leader == "" {
+		msg = "Only the leader accepts writes and no leader is known yet"
+	}
+	d := &errdetails.LocalizedMessage{
+		Message: msg,
+		Locale:  "en-US",
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: "NOT_LEADER",
+		Domain: "log.v1",
+		Metadata: map[string]string{
+			"leader":      e.Leader,
+			"leader_addr": e.Addr,
+		},
+	}
+	statusDetails, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return statusDetails
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotChainTail is returned by a server in a replication chain that
+// isn't its tail when asked for a consistent read, only the tail serves
+// them. It names the tail so the client can retry there.
+type ErrNotChainTail struct {
+	Tail string
+	Addr string
+}
+
+func (e ErrNotChainTail) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("Not the chain's tail, the tail is %q", e.Tail),
+	)
+	msg := fmt.Sprintf(
+		"Only the chain's tail serves consistent reads, retry on %s at %s",
+		e.Tail,
+		e.Addr,
+	)
+	if e.Tail == "" {
+		msg = "Only the chain's tail serves consistent reads and no tail is known yet"
+	}
+	d := &errdetails.LocalizedMessage{
+		Message: msg,
+		Locale:  "en-US",
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: "NOT_CHAIN_TAIL",
+		Domain: "log.v1",
+		Metadata: map[string]string{
+			"tail":      e.Tail,
+			"tail_addr": e.Addr,
+		},
+	}
+	statusDetails, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return statusDetails
+}
+
+func (e ErrNotChainTail) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrStalePlan is returned when executing a reassignment plan that no
+// longer applies, because the assignment or the cluster changed since it
+// was planned. A new plan needs to be made and reviewed.
+type ErrStalePlan struct {
+	Version uint64
+}
+
+func (e ErrStalePlan) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("Stale reassignment plan: %d", e.Version),
+	)
+	msg := fmt.Sprintf(
+		"The reassignment planned against version %d no longer applies, plan it again",
+		e.Version,
+	)
+	d := &errdetails.LocalizedMessage{
+		Message: msg,
+		Locale:  "en-US",
+	}
+	statusDetails, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return statusDetails
+}
+
+func (e ErrStalePlan) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrStaleConfig is returned when changing the cluster's config based on
+// a version that's no longer the current one. The change needs to be made
+// again against the current config.
+type ErrStaleConfig struct {
+	Version uint64
+	Current uint64
+}
+
+func (e ErrStaleConfig) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("Stale cluster config: %d, current: %d", e.Version, e.Current),
+	)
+	msg := fmt.Sprintf(
+		"The cluster config changed since version %d, it's at version %d now",
+		e.Version,
+		e.Current,
+	)
+	d := &errdetails.LocalizedMessage{
+		Message: msg,
+		Locale:  "en-US",
+	}
+	statusDetails, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return statusDetails
+}
+
+func (e ErrStaleConfig) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrKeyring is returned when members fail to change their gossip keyring,
+// naming each failed member with its error. The operation can be retried
+// since members that succeeded aren't affected by a retry.
+type ErrKeyring struct {
+	Failed   int
+	Members  int
+	Messages map[string]string
+}
+
+func (e ErrKeyring) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("Keyring change failed on %d of %d members", e.Failed, e.Members),
+	)
+	d := &errdetails.LocalizedMessage{
+		Message: "Some members failed to change their gossip keyring, retry once they're healthy",
+		Locale:  "en-US",
+	}
+	info := &errdetails.ErrorInfo{
+		Reason:   "KEYRING_FAILED",
+		Domain:   "log.v1",
+		Metadata: e.Messages,
+	}
+	statusDetails, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return statusDetails
+}
+
+func (e ErrKeyring) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUntrustedACL is returned when the cluster's acl rules are changed by a
+// member other than the leader, or over unencrypted gossip where any host
+// could forge the change.
+type ErrUntrustedACL struct {
+	Member string
+}
+
+func (e ErrUntrustedACL) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("Untrusted acl change from member: %s", e.Member),
+	)
+	d := &errdetails.LocalizedMessage{
+		Message: "Acl rules can only be changed on the leader of a cluster whose gossip is encrypted",
+		Locale:  "en-US",
+	}
+	statusDetails, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return statusDetails
+}
+
+func (e ErrUntrustedACL) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -26,6 +26,26 @@ type LogClient interface {
 	Consume(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (*ConsumeResponse, error)
 	ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (Log_ConsumeStreamClient, error)
 	ProduceStream(ctx context.Context, opts ...grpc.CallOption) (Log_ProduceStreamClient, error)
+	InitProducer(ctx context.Context, in *InitProducerRequest, opts ...grpc.CallOption) (*InitProducerResponse, error)
+	BeginTxn(ctx context.Context, in *BeginTxnRequest, opts ...grpc.CallOption) (*BeginTxnResponse, error)
+	AddRecords(ctx context.Context, in *AddRecordsRequest, opts ...grpc.CallOption) (*AddRecordsResponse, error)
+	CommitTxn(ctx context.Context, in *EndTxnRequest, opts ...grpc.CallOption) (*EndTxnResponse, error)
+	AbortTxn(ctx context.Context, in *EndTxnRequest, opts ...grpc.CallOption) (*EndTxnResponse, error)
+	GetReplicas(ctx context.Context, in *GetReplicasRequest, opts ...grpc.CallOption) (*GetReplicasResponse, error)
+	Replicate(ctx context.Context, opts ...grpc.CallOption) (Log_ReplicateClient, error)
+	GetSnapshot(ctx context.Context, in *GetSnapshotRequest, opts ...grpc.CallOption) (Log_GetSnapshotClient, error)
+	GetChecksums(ctx context.Context, in *GetChecksumsRequest, opts ...grpc.CallOption) (*GetChecksumsResponse, error)
+	TransferLeadership(ctx context.Context, in *TransferLeadershipRequest, opts ...grpc.CallOption) (*TransferLeadershipResponse, error)
+	Decommission(ctx context.Context, in *DecommissionRequest, opts ...grpc.CallOption) (Log_DecommissionClient, error)
+	GetServers(ctx context.Context, in *GetServersRequest, opts ...grpc.CallOption) (*GetServersResponse, error)
+	GetAssignment(ctx context.Context, in *GetAssignmentRequest, opts ...grpc.CallOption) (*Assignment, error)
+	PlanReassignment(ctx context.Context, in *PlanReassignmentRequest, opts ...grpc.CallOption) (*ReassignmentPlan, error)
+	ExecuteReassignment(ctx context.Context, in *ExecuteReassignmentRequest, opts ...grpc.CallOption) (*Assignment, error)
+	TranslateOffset(ctx context.Context, in *TranslateOffsetRequest, opts ...grpc.CallOption) (*TranslateOffsetResponse, error)
+	Keyring(ctx context.Context, in *KeyringRequest, opts ...grpc.CallOption) (*KeyringResponse, error)
+	WatchMembers(ctx context.Context, in *WatchMembersRequest, opts ...grpc.CallOption) (Log_WatchMembersClient, error)
+	GetClusterConfig(ctx context.Context, in *GetClusterConfigRequest, opts ...grpc.CallOption) (*GetClusterConfigResponse, error)
+	SetClusterConfig(ctx context.Context, in *SetClusterConfigRequest, opts ...grpc.CallOption) (*ClusterConfig, error)
 }
 
 type logClient struct {
@@ -117,6 +137,277 @@ func (x *logProduceStreamClient) Recv() (*ProduceResponse, error) {
 	return m, nil
 }
 
+func (c *logClient) InitProducer(ctx context.Context, in *InitProducerRequest, opts ...grpc.CallOption) (*InitProducerResponse, error) {
+	out := new(InitProducerResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/InitProducer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) BeginTxn(ctx context.Context, in *BeginTxnRequest, opts ...grpc.CallOption) (*BeginTxnResponse, error) {
+	out := new(BeginTxnResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/BeginTxn", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) AddRecords(ctx context.Context, in *AddRecordsRequest, opts ...grpc.CallOption) (*AddRecordsResponse, error) {
+	out := new(AddRecordsResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/AddRecords", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) CommitTxn(ctx context.Context, in *EndTxnRequest, opts ...grpc.CallOption) (*EndTxnResponse, error) {
+	out := new(EndTxnResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/CommitTxn", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) AbortTxn(ctx context.Context, in *EndTxnRequest, opts ...grpc.CallOption) (*EndTxnResponse, error) {
+	out := new(EndTxnResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/AbortTxn", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) GetReplicas(ctx context.Context, in *GetReplicasRequest, opts ...grpc.CallOption) (*GetReplicasResponse, error) {
+	out := new(GetReplicasResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/GetReplicas", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) Replicate(ctx context.Context, opts ...grpc.CallOption) (Log_ReplicateClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Log_ServiceDesc.Streams[2], "/log.v1.Log/Replicate", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logReplicateClient{stream}
+	return x, nil
+}
+
+type Log_ReplicateClient interface {
+	Send(*ReplicateRequest) error
+	Recv() (*ReplicateResponse, error)
+	grpc.ClientStream
+}
+
+type logReplicateClient struct {
+	grpc.ClientStream
+}
+
+func (x *logReplicateClient) Send(m *ReplicateRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *logReplicateClient) Recv() (*ReplicateResponse, error) {
+	m := new(ReplicateResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *logClient) GetSnapshot(ctx context.Context, in *GetSnapshotRequest, opts ...grpc.CallOption) (Log_GetSnapshotClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Log_ServiceDesc.Streams[3], "/log.v1.Log/GetSnapshot", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logGetSnapshotClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Log_GetSnapshotClient interface {
+	Recv() (*SnapshotChunk, error)
+	grpc.ClientStream
+}
+
+type logGetSnapshotClient struct {
+	grpc.ClientStream
+}
+
+func (x *logGetSnapshotClient) Recv() (*SnapshotChunk, error) {
+	m := new(SnapshotChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *logClient) GetChecksums(ctx context.Context, in *GetChecksumsRequest, opts ...grpc.CallOption) (*GetChecksumsResponse, error) {
+	out := new(GetChecksumsResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/GetChecksums", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) TransferLeadership(ctx context.Context, in *TransferLeadershipRequest, opts ...grpc.CallOption) (*TransferLeadershipResponse, error) {
+	out := new(TransferLeadershipResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/TransferLeadership", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) Decommission(ctx context.Context, in *DecommissionRequest, opts ...grpc.CallOption) (Log_DecommissionClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Log_ServiceDesc.Streams[4], "/log.v1.Log/Decommission", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logDecommissionClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Log_DecommissionClient interface {
+	Recv() (*DecommissionProgress, error)
+	grpc.ClientStream
+}
+
+type logDecommissionClient struct {
+	grpc.ClientStream
+}
+
+func (x *logDecommissionClient) Recv() (*DecommissionProgress, error) {
+	m := new(DecommissionProgress)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *logClient) GetServers(ctx context.Context, in *GetServersRequest, opts ...grpc.CallOption) (*GetServersResponse, error) {
+	out := new(GetServersResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/GetServers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) GetAssignment(ctx context.Context, in *GetAssignmentRequest, opts ...grpc.CallOption) (*Assignment, error) {
+	out := new(Assignment)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/GetAssignment", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) PlanReassignment(ctx context.Context, in *PlanReassignmentRequest, opts ...grpc.CallOption) (*ReassignmentPlan, error) {
+	out := new(ReassignmentPlan)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/PlanReassignment", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) ExecuteReassignment(ctx context.Context, in *ExecuteReassignmentRequest, opts ...grpc.CallOption) (*Assignment, error) {
+	out := new(Assignment)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/ExecuteReassignment", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) TranslateOffset(ctx context.Context, in *TranslateOffsetRequest, opts ...grpc.CallOption) (*TranslateOffsetResponse, error) {
+	out := new(TranslateOffsetResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/TranslateOffset", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) Keyring(ctx context.Context, in *KeyringRequest, opts ...grpc.CallOption) (*KeyringResponse, error) {
+	out := new(KeyringResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/Keyring", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) WatchMembers(ctx context.Context, in *WatchMembersRequest, opts ...grpc.CallOption) (Log_WatchMembersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Log_ServiceDesc.Streams[5], "/log.v1.Log/WatchMembers", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logWatchMembersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Log_WatchMembersClient interface {
+	Recv() (*MemberEvent, error)
+	grpc.ClientStream
+}
+
+type logWatchMembersClient struct {
+	grpc.ClientStream
+}
+
+func (x *logWatchMembersClient) Recv() (*MemberEvent, error) {
+	m := new(MemberEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *logClient) GetClusterConfig(ctx context.Context, in *GetClusterConfigRequest, opts ...grpc.CallOption) (*GetClusterConfigResponse, error) {
+	out := new(GetClusterConfigResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/GetClusterConfig", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) SetClusterConfig(ctx context.Context, in *SetClusterConfigRequest, opts ...grpc.CallOption) (*ClusterConfig, error) {
+	out := new(ClusterConfig)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/SetClusterConfig", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // LogServer is the server API for Log service.
 // All implementations must embed UnimplementedLogServer
 // for forward compatibility
@@ -125,6 +416,26 @@ type LogServer interface {
 	Consume(context.Context, *ConsumeRequest) (*ConsumeResponse, error)
 	ConsumeStream(*ConsumeRequest, Log_ConsumeStreamServer) error
 	ProduceStream(Log_ProduceStreamServer) error
+	InitProducer(context.Context, *InitProducerRequest) (*InitProducerResponse, error)
+	BeginTxn(context.Context, *BeginTxnRequest) (*BeginTxnResponse, error)
+	AddRecords(context.Context, *AddRecordsRequest) (*AddRecordsResponse, error)
+	CommitTxn(context.Context, *EndTxnRequest) (*EndTxnResponse, error)
+	AbortTxn(context.Context, *EndTxnRequest) (*EndTxnResponse, error)
+	GetReplicas(context.Context, *GetReplicasRequest) (*GetReplicasResponse, error)
+	Replicate(Log_ReplicateServer) error
+	GetSnapshot(*GetSnapshotRequest, Log_GetSnapshotServer) error
+	GetChecksums(context.Context, *GetChecksumsRequest) (*GetChecksumsResponse, error)
+	TransferLeadership(context.Context, *TransferLeadershipRequest) (*TransferLeadershipResponse, error)
+	Decommission(*DecommissionRequest, Log_DecommissionServer) error
+	GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error)
+	GetAssignment(context.Context, *GetAssignmentRequest) (*Assignment, error)
+	PlanReassignment(context.Context, *PlanReassignmentRequest) (*ReassignmentPlan, error)
+	ExecuteReassignment(context.Context, *ExecuteReassignmentRequest) (*Assignment, error)
+	TranslateOffset(context.Context, *TranslateOffsetRequest) (*TranslateOffsetResponse, error)
+	Keyring(context.Context, *KeyringRequest) (*KeyringResponse, error)
+	WatchMembers(*WatchMembersRequest, Log_WatchMembersServer) error
+	GetClusterConfig(context.Context, *GetClusterConfigRequest) (*GetClusterConfigResponse, error)
+	SetClusterConfig(context.Context, *SetClusterConfigRequest) (*ClusterConfig, error)
 	mustEmbedUnimplementedLogServer()
 }
 
@@ -144,6 +455,66 @@ func (UnimplementedLogServer) ConsumeStream(*ConsumeRequest, Log_ConsumeStreamSe
 func (UnimplementedLogServer) ProduceStream(Log_ProduceStreamServer) error {
 	return status.Errorf(codes.Unimplemented, "method ProduceStream not implemented")
 }
+func (UnimplementedLogServer) InitProducer(context.Context, *InitProducerRequest) (*InitProducerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method InitProducer not implemented")
+}
+func (UnimplementedLogServer) BeginTxn(context.Context, *BeginTxnRequest) (*BeginTxnResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BeginTxn not implemented")
+}
+func (UnimplementedLogServer) AddRecords(context.Context, *AddRecordsRequest) (*AddRecordsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddRecords not implemented")
+}
+func (UnimplementedLogServer) CommitTxn(context.Context, *EndTxnRequest) (*EndTxnResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CommitTxn not implemented")
+}
+func (UnimplementedLogServer) AbortTxn(context.Context, *EndTxnRequest) (*EndTxnResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AbortTxn not implemented")
+}
+func (UnimplementedLogServer) GetReplicas(context.Context, *GetReplicasRequest) (*GetReplicasResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetReplicas not implemented")
+}
+func (UnimplementedLogServer) Replicate(Log_ReplicateServer) error {
+	return status.Errorf(codes.Unimplemented, "method Replicate not implemented")
+}
+func (UnimplementedLogServer) GetSnapshot(*GetSnapshotRequest, Log_GetSnapshotServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetSnapshot not implemented")
+}
+func (UnimplementedLogServer) GetChecksums(context.Context, *GetChecksumsRequest) (*GetChecksumsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetChecksums not implemented")
+}
+func (UnimplementedLogServer) TransferLeadership(context.Context, *TransferLeadershipRequest) (*TransferLeadershipResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TransferLeadership not implemented")
+}
+func (UnimplementedLogServer) Decommission(*DecommissionRequest, Log_DecommissionServer) error {
+	return status.Errorf(codes.Unimplemented, "method Decommission not implemented")
+}
+func (UnimplementedLogServer) GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetServers not implemented")
+}
+func (UnimplementedLogServer) GetAssignment(context.Context, *GetAssignmentRequest) (*Assignment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetAssignment not implemented")
+}
+func (UnimplementedLogServer) PlanReassignment(context.Context, *PlanReassignmentRequest) (*ReassignmentPlan, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PlanReassignment not implemented")
+}
+func (UnimplementedLogServer) ExecuteReassignment(context.Context, *ExecuteReassignmentRequest) (*Assignment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExecuteReassignment not implemented")
+}
+func (UnimplementedLogServer) TranslateOffset(context.Context, *TranslateOffsetRequest) (*TranslateOffsetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TranslateOffset not implemented")
+}
+func (UnimplementedLogServer) Keyring(context.Context, *KeyringRequest) (*KeyringResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Keyring not implemented")
+}
+func (UnimplementedLogServer) WatchMembers(*WatchMembersRequest, Log_WatchMembersServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchMembers not implemented")
+}
+func (UnimplementedLogServer) GetClusterConfig(context.Context, *GetClusterConfigRequest) (*GetClusterConfigResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetClusterConfig not implemented")
+}
+func (UnimplementedLogServer) SetClusterConfig(context.Context, *SetClusterConfigRequest) (*ClusterConfig, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetClusterConfig not implemented")
+}
 func (UnimplementedLogServer) mustEmbedUnimplementedLogServer() {}
 
 // UnsafeLogServer may be embedded to opt out of forward compatibility for this service.
@@ -240,33 +611,495 @@ func (x *logProduceStreamServer) Recv() (*ProduceRequest, error) {
 	return m, nil
 }
 
-// Log_ServiceDesc is the grpc.ServiceDesc for Log service.
-// It's only intended for direct use with grpc.RegisterService,
-// and not to be introspected or modified (even as a copy)
-var Log_ServiceDesc = grpc.ServiceDesc{
-	ServiceName: "log.v1.Log",
-	HandlerType: (*LogServer)(nil),
-	Methods: []grpc.MethodDesc{
-		{
-			MethodName: "Produce",
-			Handler:    _Log_Produce_Handler,
-		},
-		{
-			MethodName: "Consume",
-			Handler:    _Log_Consume_Handler,
-		},
-	},
-	Streams: []grpc.StreamDesc{
-		{
-			StreamName:    "ConsumeStream",
-			Handler:       _Log_ConsumeStream_Handler,
-			ServerStreams: true,
-		},
-		{
-			StreamName:    "ProduceStream",
-			Handler:       _Log_ProduceStream_Handler,
-			ServerStreams: true,
-			ClientStreams: true,
+func _Log_InitProducer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InitProducerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).InitProducer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/InitProducer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).InitProducer(ctx, req.(*InitProducerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_BeginTxn_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BeginTxnRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).BeginTxn(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/BeginTxn",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).BeginTxn(ctx, req.(*BeginTxnRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_AddRecords_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddRecordsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).AddRecords(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/AddRecords",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).AddRecords(ctx, req.(*AddRecordsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_CommitTxn_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EndTxnRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).CommitTxn(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/CommitTxn",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).CommitTxn(ctx, req.(*EndTxnRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_AbortTxn_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EndTxnRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).AbortTxn(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/AbortTxn",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).AbortTxn(ctx, req.(*EndTxnRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_GetReplicas_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetReplicasRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetReplicas(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/GetReplicas",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetReplicas(ctx, req.(*GetReplicasRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_Replicate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LogServer).Replicate(&logReplicateServer{stream})
+}
+
+type Log_ReplicateServer interface {
+	Send(*ReplicateResponse) error
+	Recv() (*ReplicateRequest, error)
+	grpc.ServerStream
+}
+
+type logReplicateServer struct {
+	grpc.ServerStream
+}
+
+func (x *logReplicateServer) Send(m *ReplicateResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *logReplicateServer) Recv() (*ReplicateRequest, error) {
+	m := new(ReplicateRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Log_GetSnapshot_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetSnapshotRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LogServer).GetSnapshot(m, &logGetSnapshotServer{stream})
+}
+
+type Log_GetSnapshotServer interface {
+	Send(*SnapshotChunk) error
+	grpc.ServerStream
+}
+
+type logGetSnapshotServer struct {
+	grpc.ServerStream
+}
+
+func (x *logGetSnapshotServer) Send(m *SnapshotChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Log_GetChecksums_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetChecksumsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetChecksums(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/GetChecksums",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetChecksums(ctx, req.(*GetChecksumsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_TransferLeadership_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TransferLeadershipRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).TransferLeadership(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/TransferLeadership",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).TransferLeadership(ctx, req.(*TransferLeadershipRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_Decommission_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DecommissionRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LogServer).Decommission(m, &logDecommissionServer{stream})
+}
+
+type Log_DecommissionServer interface {
+	Send(*DecommissionProgress) error
+	grpc.ServerStream
+}
+
+type logDecommissionServer struct {
+	grpc.ServerStream
+}
+
+func (x *logDecommissionServer) Send(m *DecommissionProgress) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Log_GetServers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetServersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetServers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/GetServers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetServers(ctx, req.(*GetServersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_GetAssignment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetAssignmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetAssignment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/GetAssignment",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetAssignment(ctx, req.(*GetAssignmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_PlanReassignment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PlanReassignmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).PlanReassignment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/PlanReassignment",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).PlanReassignment(ctx, req.(*PlanReassignmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_ExecuteReassignment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExecuteReassignmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).ExecuteReassignment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/ExecuteReassignment",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).ExecuteReassignment(ctx, req.(*ExecuteReassignmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_TranslateOffset_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TranslateOffsetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).TranslateOffset(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/TranslateOffset",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).TranslateOffset(ctx, req.(*TranslateOffsetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_Keyring_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KeyringRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).Keyring(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/Keyring",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).Keyring(ctx, req.(*KeyringRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_WatchMembers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchMembersRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LogServer).WatchMembers(m, &logWatchMembersServer{stream})
+}
+
+type Log_WatchMembersServer interface {
+	Send(*MemberEvent) error
+	grpc.ServerStream
+}
+
+type logWatchMembersServer struct {
+	grpc.ServerStream
+}
+
+func (x *logWatchMembersServer) Send(m *MemberEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Log_GetClusterConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetClusterConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetClusterConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/GetClusterConfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetClusterConfig(ctx, req.(*GetClusterConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_SetClusterConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetClusterConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).SetClusterConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/SetClusterConfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).SetClusterConfig(ctx, req.(*SetClusterConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Log_ServiceDesc is the grpc.ServiceDesc for Log service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Log_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "log.v1.Log",
+	HandlerType: (*LogServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Produce",
+			Handler:    _Log_Produce_Handler,
+		},
+		{
+			MethodName: "Consume",
+			Handler:    _Log_Consume_Handler,
+		},
+		{
+			MethodName: "InitProducer",
+			Handler:    _Log_InitProducer_Handler,
+		},
+		{
+			MethodName: "BeginTxn",
+			Handler:    _Log_BeginTxn_Handler,
+		},
+		{
+			MethodName: "AddRecords",
+			Handler:    _Log_AddRecords_Handler,
+		},
+		{
+			MethodName: "CommitTxn",
+			Handler:    _Log_CommitTxn_Handler,
+		},
+		{
+			MethodName: "AbortTxn",
+			Handler:    _Log_AbortTxn_Handler,
+		},
+		{
+			MethodName: "GetReplicas",
+			Handler:    _Log_GetReplicas_Handler,
+		},
+		{
+			MethodName: "GetChecksums",
+			Handler:    _Log_GetChecksums_Handler,
+		},
+		{
+			MethodName: "TransferLeadership",
+			Handler:    _Log_TransferLeadership_Handler,
+		},
+		{
+			MethodName: "GetServers",
+			Handler:    _Log_GetServers_Handler,
+		},
+		{
+			MethodName: "GetAssignment",
+			Handler:    _Log_GetAssignment_Handler,
+		},
+		{
+			MethodName: "PlanReassignment",
+			Handler:    _Log_PlanReassignment_Handler,
+		},
+		{
+			MethodName: "ExecuteReassignment",
+			Handler:    _Log_ExecuteReassignment_Handler,
+		},
+		{
+			MethodName: "TranslateOffset",
+			Handler:    _Log_TranslateOffset_Handler,
+		},
+		{
+			MethodName: "Keyring",
+			Handler:    _Log_Keyring_Handler,
+		},
+		{
+			MethodName: "GetClusterConfig",
+			Handler:    _Log_GetClusterConfig_Handler,
+		},
+		{
+			MethodName: "SetClusterConfig",
+			Handler:    _Log_SetClusterConfig_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ConsumeStream",
+			Handler:       _Log_ConsumeStream_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ProduceStream",
+			Handler:       _Log_ProduceStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Replicate",
+			Handler:       _Log_Replicate_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "GetSnapshot",
+			Handler:       _Log_GetSnapshot_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Decommission",
+			Handler:       _Log_Decommission_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchMembers",
+			Handler:       _Log_WatchMembers_Handler,
+			ServerStreams: true,
 		},
 	},
 	Metadata: "log_package/api/v1/log.proto",
@@ -0,0 +1,258 @@
+package discovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// A changed cluster config is broadcast to every member in a user event.
+// User events are best effort and members joining later never see them,
+// so members also gossip the version they applied, and a member seeing a
+// later version asks that member for its config with a query.
+//
+// Acl rules grant access to the servers, so a config changing them is only
+// accepted over encrypted gossip and from the leader: the leader
+// broadcasting the change, or the leader answering the query for it.
+const (
+	configEvent      = "cluster-config"
+	configQuery      = "cluster-config"
+	configVersionTag = "config_version"
+)
+
+// ClusterConfig returns the config the member applied, at version 0 until
+// the cluster's config is first changed.
+func (m *Membership) ClusterConfig() *api.ClusterConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.clusterConfig()
+}
+
+func (m *Membership) clusterConfig() *api.ClusterConfig {
+	if m.config == nil {
+		return &api.ClusterConfig{}
+	}
+	return proto.Clone(m.config).(*api.ClusterConfig)
+}
+
+// SetClusterConfig changes every member's config to the given one as the
+// next version. It fails with api.ErrStaleConfig unless the config's
+// version is the one the local member applied, so a change made against
+// an old config doesn't undo the changes since. Changing the acl rules
+// fails with api.ErrUntrustedACL unless the local member leads and gossip
+// is encrypted.
+func (m *Membership) SetClusterConfig(config *api.ClusterConfig) (*api.ClusterConfig, error) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	current := m.ClusterConfig()
+	if config.Version != current.Version {
+		return nil, api.ErrStaleConfig{Version: config.Version, Current: current.Version}
+	}
+	if err := m.trustACL(config, m.NodeName); err != nil {
+		return nil, err
+	}
+	next := proto.Clone(config).(*api.ClusterConfig)
+	next.Version++
+	next.Origin = m.NodeName
+	b, err := proto.Marshal(next)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.serf.UserEvent(configEvent, b, false); err != nil {
+		return nil, err
+	}
+	// the event reaches the local member too, but applying it now means
+	// the change is in effect here once it returns
+	if err = m.adopt(next, m.NodeName); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// ConfigVersions returns the version of the config each alive member has
+// applied.
+func (m *Membership) ConfigVersions() map[string]uint64 {
+	versions := make(map[string]uint64)
+	for _, member := range m.serf.Members() {
+		if member.Status != serf.StatusAlive {
+			continue
+		}
+		version, _ := strconv.ParseUint(member.Tags[configVersionTag], 10, 64)
+		versions[member.Name] = version
+	}
+	return versions
+}
+
+// adoptConfig applies the config if it's later than the one the member
+// has, keeping it in the config file and gossiping its version. from is
+// the member the config came from, which has to be the leader if the
+// config changes the acl rules.
+func (m *Membership) adoptConfig(config *api.ClusterConfig, from string) error {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	return m.adopt(config, from)
+}
+
+func (m *Membership) adopt(config *api.ClusterConfig, from string) error {
+	current := m.ClusterConfig()
+	if config.Version < current.Version ||
+		(config.Version == current.Version && config.Origin <= current.Origin) {
+		return nil
+	}
+	if err := m.trustACL(config, from); err != nil {
+		return err
+	}
+	if err := m.saveClusterConfig(config); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.config = proto.Clone(config).(*api.ClusterConfig)
+	m.mu.Unlock()
+	if m.ApplyClusterConfig != nil {
+		m.ApplyClusterConfig(config)
+	}
+	// setting tags raises an event, which would block the event handler
+	// calling this
+	go func() {
+		if err := m.updateTags(); err != nil {
+			m.logger.Error("failed to gossip config version", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// trustACL checks the member a config came from may change the acl rules
+// if the config changes them.
+func (m *Membership) trustACL(config *api.ClusterConfig, from string) error {
+	if aclEqual(config.Acl, m.ClusterConfig().Acl) {
+		return nil
+	}
+	if leader, _, _ := m.Leader(); !m.serf.EncryptionEnabled() || from != leader {
+		return api.ErrUntrustedACL{Member: from}
+	}
+	return nil
+}
+
+func aclEqual(a, b []*api.AclRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !proto.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleConfigEvent applies a config broadcast by another member, which
+// is the one that changed it.
+func (m *Membership) handleConfigEvent(e serf.UserEvent) {
+	config := &api.ClusterConfig{}
+	if err := proto.Unmarshal(e.Payload, config); err != nil {
+		m.logger.Error("failed to decode cluster config", zap.Error(err))
+		return
+	}
+	if err := m.adoptConfig(config, config.Origin); err != nil {
+		m.logger.Error("failed to apply cluster config", zap.Error(err))
+	}
+}
+
+// handleConfigQuery answers another member asking for the local config.
+func (m *Membership) handleConfigQuery(q *serf.Query) {
+	b, err := proto.Marshal(m.ClusterConfig())
+	if err == nil {
+		err = q.Respond(b)
+	}
+	if err != nil {
+		m.logger.Error("failed to answer config query", zap.Error(err))
+	}
+}
+
+// observeConfig fetches the config of a member gossiping a later version
+// than the local one, which happens when the local member missed the
+// change's event.
+func (m *Membership) observeConfig(member serf.Member) {
+	version, err := strconv.ParseUint(member.Tags[configVersionTag], 10, 64)
+	if err != nil || version <= m.ClusterConfig().Version {
+		return
+	}
+	// the query waits for the answer, which would hold up the event
+	// handler calling this
+	go func() {
+		if err := m.fetchConfig(member.Name); err != nil {
+			m.logError(err, "failed to fetch cluster config", member)
+		}
+	}()
+}
+
+// fetchConfig asks the named member for its config. A config changing the
+// acl rules that the member can't vouch for is asked of the leader
+// instead, since it holds the rules it last set.
+func (m *Membership) fetchConfig(name string) error {
+	res, err := m.serf.Query(configQuery, nil, &serf.QueryParam{
+		FilterNodes: []string{name},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	for r := range res.ResponseCh() {
+		config := &api.ClusterConfig{}
+		if err := proto.Unmarshal(r.Payload, config); err != nil {
+			return err
+		}
+		err := m.adoptConfig(config, r.From)
+		if _, ok := err.(api.ErrUntrustedACL); ok {
+			if leader, _, _ := m.Leader(); leader != "" && leader != r.From {
+				return m.fetchConfig(leader)
+			}
+		}
+		return err
+	}
+	return fmt.Errorf("member %s didn't answer", name)
+}
+
+// loadClusterConfig loads the config the member applied before it last
+// stopped.
+func (m *Membership) loadClusterConfig() error {
+	if m.ClusterConfigFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(m.ClusterConfigFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	config := &api.ClusterConfig{}
+	if err = proto.Unmarshal(b, config); err != nil {
+		return err
+	}
+	m.config = config
+	if m.ApplyClusterConfig != nil {
+		m.ApplyClusterConfig(config)
+	}
+	return nil
+}
+
+func (m *Membership) saveClusterConfig(config *api.ClusterConfig) error {
+	if m.ClusterConfigFile == "" {
+		return nil
+	}
+	b, err := proto.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(m.ClusterConfigFile+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(m.ClusterConfigFile+".tmp", m.ClusterConfigFile)
+}
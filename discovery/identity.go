@@ -0,0 +1,162 @@
+package discovery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// Every member gossips the cluster it belongs to and its own node id, which
+// unlike its name never changes once it's picked. Members gossiping another
+// cluster's id are refused, so a member pointed at the wrong cluster fails
+// to join rather than mixing two clusters' logs.
+const (
+	clusterIDTag = "cluster_id"
+	nodeIDTag    = "node_id"
+)
+
+type identity struct {
+	ClusterID string `json:"cluster_id"`
+	NodeID    string `json:"node_id"`
+}
+
+// setupIdentity loads the ids the member kept in its id file, picking a
+// node id the first time it starts. The bootstrap member also picks the
+// cluster id, other members adopt the id of the cluster they first join.
+// A configured cluster id must match the one kept.
+func (m *Membership) setupIdentity() error {
+	id, err := m.loadIdentity()
+	if err != nil {
+		return err
+	}
+	configured := m.Config.ClusterID
+	if id.ClusterID != "" && configured != "" && id.ClusterID != configured {
+		return fmt.Errorf(
+			"%s belongs to cluster %s, not the configured cluster %s",
+			m.IDFile, id.ClusterID, configured,
+		)
+	}
+	if id.ClusterID == "" {
+		id.ClusterID = configured
+	}
+	if id.ClusterID == "" && m.Bootstrap {
+		if id.ClusterID, err = newID(); err != nil {
+			return err
+		}
+	}
+	if id.NodeID == "" {
+		if id.NodeID, err = newID(); err != nil {
+			return err
+		}
+	}
+	m.clusterID, m.nodeID = id.ClusterID, id.NodeID
+	return m.saveIdentity(id)
+}
+
+// ClusterID returns the id of the cluster the member belongs to, empty
+// until it's joined one.
+func (m *Membership) ClusterID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.clusterID
+}
+
+// NodeID returns the member's id.
+func (m *Membership) NodeID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.nodeID
+}
+
+// NotifyMerge refuses members of another cluster, whether the local member
+// is joining them or they're joining it, and members claiming the local
+// member's node id. Members without a cluster id are new to the cluster and
+// let in. The first time the local member sees a cluster id it adopts it.
+func (m *Membership) NotifyMerge(members []*serf.Member) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cluster := m.clusterID
+	for _, member := range members {
+		if member.Name == m.NodeName {
+			continue
+		}
+		if id := member.Tags[nodeIDTag]; id != "" && id == m.nodeID {
+			return fmt.Errorf(
+				"member %s has this member's node id %s, was its data dir copied?",
+				member.Name, id,
+			)
+		}
+		id := member.Tags[clusterIDTag]
+		if id == "" {
+			continue
+		}
+		if cluster == "" {
+			cluster = id
+		}
+		if id != cluster {
+			return fmt.Errorf(
+				"member %s belongs to cluster %s, not cluster %s",
+				member.Name, id, cluster,
+			)
+		}
+	}
+	if cluster == m.clusterID {
+		return nil
+	}
+	if err := m.saveIdentity(identity{ClusterID: cluster, NodeID: m.nodeID}); err != nil {
+		return err
+	}
+	m.clusterID = cluster
+	// serf is merging, it can't take the new tags until it's done
+	go func() {
+		if err := m.updateTags(); err != nil {
+			m.logger.Error("failed to gossip cluster id", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+func (m *Membership) loadIdentity() (identity, error) {
+	var id identity
+	if m.IDFile == "" {
+		return id, nil
+	}
+	b, err := ioutil.ReadFile(m.IDFile)
+	if os.IsNotExist(err) {
+		return id, nil
+	}
+	if err != nil {
+		return id, err
+	}
+	return id, json.Unmarshal(b, &id)
+}
+
+// saveIdentity writes the ids to a temporary file first, so a crash never
+// leaves the member without them.
+func (m *Membership) saveIdentity(id identity) error {
+	if m.IDFile == "" {
+		return nil
+	}
+	b, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(m.IDFile+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(m.IDFile+".tmp", m.IDFile)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,112 @@
+package discovery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+)
+
+// setupKeyring encrypts gossip when the member has keys, so hosts without
+// them can't read gossip or join. Keys in the keyring file win over
+// EncryptKey since they hold the rotations made after the member first
+// started, and serf rewrites the file on every change.
+func (m *Membership) setupKeyring(config *serf.Config) error {
+	config.KeyringFile = m.KeyringFile
+	keys, err := m.loadKeyring()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 && len(m.EncryptKey) > 0 {
+		keys = [][]byte{m.EncryptKey}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	// the primary key comes first in the file
+	keyring, err := memberlist.NewKeyring(keys, keys[0])
+	if err != nil {
+		return err
+	}
+	config.MemberlistConfig.Keyring = keyring
+	return nil
+}
+
+func (m *Membership) loadKeyring() ([][]byte, error) {
+	if m.KeyringFile == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(m.KeyringFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var encoded []string
+	if err := json.Unmarshal(b, &encoded); err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, 0, len(encoded))
+	for _, e := range encoded {
+		key, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// InstallKey adds the base64 encoded key to every member's keyring.
+func (m *Membership) InstallKey(key string) (*api.KeyringResponse, error) {
+	return keyringResponse(m.serf.KeyManager().InstallKey(key))
+}
+
+// UseKey makes every member encrypt gossip with the installed key.
+func (m *Membership) UseKey(key string) (*api.KeyringResponse, error) {
+	return keyringResponse(m.serf.KeyManager().UseKey(key))
+}
+
+// RemoveKey drops the key from every member's keyring. The key in use
+// can't be removed.
+func (m *Membership) RemoveKey(key string) (*api.KeyringResponse, error) {
+	return keyringResponse(m.serf.KeyManager().RemoveKey(key))
+}
+
+// ListKeys reports the keys members hold and encrypt with.
+func (m *Membership) ListKeys() (*api.KeyringResponse, error) {
+	return keyringResponse(m.serf.KeyManager().ListKeys())
+}
+
+// keyringResponse fails with api.ErrKeyring when members failed or didn't
+// answer, since the keyrings then differ across the cluster.
+func keyringResponse(resp *serf.KeyResponse, err error) (*api.KeyringResponse, error) {
+	if resp == nil || (err != nil && resp.NumNodes == 0) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, api.ErrKeyring{
+			Failed:   resp.NumNodes - resp.NumResp + resp.NumErr,
+			Members:  resp.NumNodes,
+			Messages: resp.Messages,
+		}
+	}
+	res := &api.KeyringResponse{
+		Members:     int32(resp.NumNodes),
+		Responses:   int32(resp.NumResp),
+		Keys:        make(map[string]int32, len(resp.Keys)),
+		PrimaryKeys: make(map[string]int32, len(resp.PrimaryKeys)),
+	}
+	for key, n := range resp.Keys {
+		res.Keys[key] = int32(n)
+	}
+	for key, n := range resp.PrimaryKeys {
+		res.PrimaryKeys[key] = int32(n)
+	}
+	return res, nil
+}
@@ -0,0 +1,281 @@
+package discovery
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// The leader is gossiped in every member's tags along with the epoch it
+// was picked in. Members adopt the leader of the highest epoch they see and
+// pass it on in their own tags, so the whole cluster converges on it and
+// members joining later learn it too.
+//
+// The leader also gossips its in-sync voters, and when it fails those of
+// them that are alive stand for leader by gossiping their log's next
+// offset, so the one holding the most records is elected.
+const (
+	leaderTag      = "leader"
+	leaderEpochTag = "leader_epoch"
+	inSyncTag      = "in_sync"
+	candidateTag   = "candidate"
+	// defaultFailoverTimeout is how long candidates have to stand for
+	// leader when FailoverTimeout isn't set.
+	defaultFailoverTimeout = time.Second
+)
+
+// Leader returns the member leading the cluster, its RPC address and the
+// epoch it was picked in. The name is empty until a leader is known.
+func (m *Membership) Leader() (name, addr string, epoch uint64) {
+	m.mu.Lock()
+	name, epoch = m.leader, m.epoch
+	m.mu.Unlock()
+	if name == "" {
+		return "", "", 0
+	}
+	for _, member := range m.serf.Members() {
+		if member.Name == name {
+			return name, member.Tags["rpc_addr"], epoch
+		}
+	}
+	return name, "", epoch
+}
+
+// IsLeader reports whether the local member leads the cluster.
+func (m *Membership) IsLeader() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.leader == m.NodeName
+}
+
+// TransferLeadership makes the named member the leader in a new epoch.
+// The member must be an alive voter.
+func (m *Membership) TransferLeadership(name string) error {
+	if !m.alive(name) {
+		return fmt.Errorf("member %s isn't alive", name)
+	}
+	if !m.IsVoter(name) {
+		return fmt.Errorf("member %s is a non-voter", name)
+	}
+	m.mu.Lock()
+	m.leader = name
+	m.epoch++
+	m.candidate = ""
+	m.mu.Unlock()
+	return m.updateTags()
+}
+
+// AppointLeader makes the named member the leader in a new epoch when
+// there's no leader to transfer leadership from: none is known or it
+// isn't alive. The member may not hold every record the leader
+// acknowledged, so it's for when no in-sync voter could take over.
+func (m *Membership) AppointLeader(name string) error {
+	if leader, _, _ := m.Leader(); leader != "" && m.alive(leader) {
+		return fmt.Errorf("leader %s is alive, transfer leadership from it", leader)
+	}
+	return m.TransferLeadership(name)
+}
+
+// SetInSync gossips the in-sync voters while the local member leads, so
+// they can stand for leader if it fails.
+func (m *Membership) SetInSync(ids []string) error {
+	inSync := strings.Join(ids, ",")
+	m.mu.Lock()
+	changed := inSync != m.inSync
+	m.inSync = inSync
+	m.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	return m.updateTags()
+}
+
+func (m *Membership) alive(name string) bool {
+	for _, member := range m.serf.Members() {
+		if member.Name == name && member.Status == serf.StatusAlive {
+			return true
+		}
+	}
+	return false
+}
+
+// observeInSync keeps the in-sync voters the leader gossips.
+func (m *Membership) observeInSync(member serf.Member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if member.Name != m.leader {
+		return
+	}
+	m.leaderInSync = nil
+	if ids := member.Tags[inSyncTag]; ids != "" {
+		m.leaderInSync = strings.Split(ids, ",")
+	}
+}
+
+// observeFailure elects another leader once the leader failed or left.
+func (m *Membership) observeFailure(member serf.Member) {
+	m.mu.Lock()
+	leader, epoch := m.leader, m.epoch
+	candidates := m.leaderInSync
+	m.mu.Unlock()
+	if member.Name != leader || m.NextOffset == nil || m.NonVoter ||
+		!contains(candidates, m.NodeName) {
+		return
+	}
+	// standing gossips tags, which would block the event handler calling
+	// this
+	go func() {
+		if err := m.failover(epoch, candidates); err != nil {
+			m.logger.Error("failed to stand for leader", zap.Error(err))
+		}
+	}()
+}
+
+// failover stands for leader after the epoch's leader failed, gossiping
+// the local log's next offset, and takes over once the candidates had
+// time to stand if no other holds more records. Ties go to the lowest
+// name. Every candidate sees the same tags, so they agree on who takes
+// over, and should they not the later epoch's tie break settles it.
+func (m *Membership) failover(epoch uint64, candidates []string) error {
+	m.mu.Lock()
+	if m.epoch != epoch {
+		m.mu.Unlock()
+		return nil
+	}
+	m.candidate = fmt.Sprintf("%d:%d", epoch, m.NextOffset())
+	m.mu.Unlock()
+	if err := m.updateTags(); err != nil {
+		return err
+	}
+	timeout := m.FailoverTimeout
+	if timeout == 0 {
+		timeout = defaultFailoverTimeout
+	}
+	select {
+	case <-m.left:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	best, most := "", uint64(0)
+	for _, member := range m.serf.Members() {
+		if member.Status != serf.StatusAlive || !contains(candidates, member.Name) {
+			continue
+		}
+		e, next, ok := parseCandidate(member.Tags[candidateTag])
+		if !ok || e != epoch {
+			continue
+		}
+		if best == "" || next > most || (next == most && member.Name < best) {
+			best, most = member.Name, next
+		}
+	}
+	m.mu.Lock()
+	if best != m.NodeName || m.epoch != epoch {
+		m.mu.Unlock()
+		return nil
+	}
+	m.leader, m.epoch, m.candidate = m.NodeName, epoch+1, ""
+	m.mu.Unlock()
+	m.logger.Info("took over leadership", zap.Uint64("epoch", epoch+1))
+	return m.updateTags()
+}
+
+// parseCandidate reads the epoch and offset a candidate stands with.
+func parseCandidate(tag string) (epoch, next uint64, ok bool) {
+	parts := strings.SplitN(tag, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	epoch, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	next, err = strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return epoch, next, true
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// observeLeader adopts the leader in the member's tags if it was picked
+// in a later epoch than the one the local member knows. Ties are broken by
+// name so every member picks the same leader.
+func (m *Membership) observeLeader(member serf.Member) {
+	epoch, err := strconv.ParseUint(member.Tags[leaderEpochTag], 10, 64)
+	if err != nil {
+		return
+	}
+	name := member.Tags[leaderTag]
+	m.mu.Lock()
+	if epoch < m.epoch || (epoch == m.epoch && name <= m.leader) {
+		m.mu.Unlock()
+		return
+	}
+	m.leader, m.epoch = name, epoch
+	m.candidate = ""
+	m.mu.Unlock()
+	// setting tags raises an event for the local member, which would
+	// block the event handler calling this
+	go func() {
+		if err := m.updateTags(); err != nil {
+			m.logError(err, "failed to gossip leader", member)
+		}
+	}()
+}
+
+// updateTags gossips the leader, cluster and config the local member
+// knows.
+func (m *Membership) updateTags() error {
+	m.tagsMu.Lock()
+	defer m.tagsMu.Unlock()
+	return m.serf.SetTags(m.localTags())
+}
+
+// localTags returns the configured tags with the member's ids, role, zone,
+// config version and the known leader added.
+func (m *Membership) localTags() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tags := make(map[string]string, len(m.Tags)+9)
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+	if m.clusterID != "" {
+		tags[clusterIDTag] = m.clusterID
+	}
+	tags[nodeIDTag] = m.nodeID
+	if m.config != nil {
+		tags[configVersionTag] = strconv.FormatUint(m.config.Version, 10)
+	}
+	if m.NonVoter {
+		tags[roleTag] = roleNonVoter
+	}
+	if m.Zone != "" {
+		tags[zoneTag] = m.Zone
+	}
+	if m.leader != "" {
+		tags[leaderTag] = m.leader
+		tags[leaderEpochTag] = strconv.FormatUint(m.epoch, 10)
+	}
+	if m.leader == m.NodeName && m.inSync != "" {
+		tags[inSyncTag] = m.inSync
+	}
+	if m.candidate != "" {
+		tags[candidateTag] = m.candidate
+	}
+	return tags
+}
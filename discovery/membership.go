@@ -2,7 +2,10 @@ package discovery
 
 import (
 	"net"
+	"sync"
+	"time"
 
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
 	"github.com/hashicorp/serf/serf"
 	"go.uber.org/zap"
 )
@@ -12,6 +15,46 @@ type Config struct {
 	BindAddr       string
 	Tags           map[string]string
 	StartJoinAddrs []string
+	// Bootstrap makes the member the cluster's leader in the first epoch.
+	// Members that already know a later leader keep theirs.
+	Bootstrap bool
+	// NextOffset returns the local log's next offset. With it the member
+	// stands for leader when the leader fails, if it's one of the in-sync
+	// voters the leader last gossiped, and of those standing the one
+	// holding the most records takes over once FailoverTimeout, 1s by
+	// default, has passed. Without it a failed leader has to be replaced
+	// with AppointLeader.
+	NextOffset      func() uint64
+	FailoverTimeout time.Duration
+	// NonVoter makes the member a read replica that's never counted
+	// towards the in-sync replicas and never leads.
+	NonVoter bool
+	// Zone is the rack or availability zone the member runs in, gossiped
+	// so replicas can be spread across zones and reads kept in them.
+	Zone string
+	// EncryptKey encrypts gossip with a 16, 24 or 32 byte key, so only
+	// members holding it can join. KeyringFile keeps the keys installed
+	// since, so a member restarting after a rotation still has them.
+	EncryptKey  []byte
+	KeyringFile string
+	// ClusterID is the cluster the member must belong to. Without it the
+	// member belongs to the cluster it's bootstrapping or first joins.
+	// IDFile is where the member keeps its cluster and node ids, so it
+	// can't be restarted into another cluster.
+	ClusterID string
+	IDFile    string
+	// Seeds resolve members to join besides StartJoinAddrs. They're
+	// resolved again every RejoinInterval, 30s by default, and the ones
+	// that aren't alive members joined, so restarted seeds don't strand
+	// the member. With seeds a failed first join isn't fatal either, it's
+	// retried the same way.
+	Seeds          []SeedProvider
+	RejoinInterval time.Duration
+	// ApplyClusterConfig is called with every cluster config the member
+	// adopts, including the one it kept in ClusterConfigFile when it last
+	// stopped.
+	ApplyClusterConfig func(*api.ClusterConfig)
+	ClusterConfigFile  string
 }
 
 type Handler interface {
@@ -25,6 +68,34 @@ type Membership struct {
 	serf    *serf.Serf
 	events  chan serf.Event
 	logger  *zap.Logger
+
+	mu sync.Mutex
+	// leader is the member leading the cluster since epoch
+	leader string
+	epoch  uint64
+	// inSync is the in-sync voters the member gossips while leading and
+	// leaderInSync the ones the leader last gossiped. candidate is the
+	// epoch and offset the member stands for leader with after the
+	// epoch's leader failed.
+	inSync       string
+	leaderInSync []string
+	candidate    string
+	// clusterID and nodeID identify the member, see setupIdentity
+	clusterID string
+	nodeID    string
+	// config is the cluster config applied, configMu serializes adopting
+	// another
+	config   *api.ClusterConfig
+	configMu sync.Mutex
+	// tagsMu serializes gossiping the local member's tags
+	tagsMu sync.Mutex
+
+	watchMu  sync.Mutex
+	watchers map[chan *api.MemberEvent]struct{}
+
+	// left is closed once the member leaves, stopping rejoin
+	left      chan struct{}
+	leaveOnce sync.Once
 }
 
 func New(handler Handler, config Config) (*Membership, error) {
@@ -32,8 +103,15 @@ func New(handler Handler, config Config) (*Membership, error) {
 		Config:  config,
 		handler: handler,
 		logger:  zap.L().Named("membership"),
+		left:    make(chan struct{}),
 	}
 
+	if err := c.setupIdentity(); err != nil {
+		return nil, err
+	}
+	if err := c.loadClusterConfig(); err != nil {
+		return nil, err
+	}
 	if err := c.setupSerf(); err != nil {
 		return nil, err
 	}
@@ -52,16 +130,43 @@ func (m *Membership) setupSerf() (err error) {
 	config.MemberlistConfig.BindPort = addr.Port
 	m.events = make(chan serf.Event)
 	config.EventCh = m.events
-	config.Tags = m.Tags
+	if m.Bootstrap {
+		m.leader, m.epoch = m.NodeName, 1
+	}
+	config.Tags = m.localTags()
+	config.Merge = m
 	config.NodeName = m.Config.NodeName
+	if err = m.setupKeyring(config); err != nil {
+		return err
+	}
 	m.serf, err = serf.Create(config)
 	if err != nil {
 		return err
 	}
 	go m.eventHandler()
-	if m.StartJoinAddrs != nil {
-		_, err := m.serf.Join(m.StartJoinAddrs, true)
+	join := m.StartJoinAddrs
+	if len(m.Seeds) > 0 {
+		// seeds that don't resolve yet are retried by rejoin
+		seeds, err := m.resolveSeeds()
 		if err != nil {
+			m.logger.Error("failed to resolve seeds", zap.Error(err))
+		}
+		join = append(append([]string{}, join...), seeds...)
+		go m.rejoin()
+	}
+	if len(join) > 0 {
+		_, err := m.serf.Join(join, true)
+		if err != nil && len(m.Seeds) > 0 {
+			// the seeds may not be up yet, rejoin retries them
+			m.logger.Error(
+				"failed to join",
+				zap.Error(err),
+				zap.Strings("addrs", join),
+			)
+		} else if err != nil {
+			// a member refused by the cluster mustn't linger gossiping
+			m.Leave()
+			m.serf.Shutdown()
 			return err
 		}
 	}
@@ -74,19 +179,46 @@ func (m *Membership) eventHandler() {
 		case serf.EventMemberJoin:
 			for _, member := range e.(serf.MemberEvent).Members {
 				if m.isLocal(member) {
+					m.publish(api.MemberEventType_MEMBER_JOIN, member)
 					continue
 				}
+				// watchers learn of the leader the member gossips
+				m.observeLeader(member)
+				m.observeInSync(member)
+				m.observeConfig(member)
+				m.publish(api.MemberEventType_MEMBER_JOIN, member)
 				m.handleJoin(member)
 			}
+		case serf.EventMemberUpdate:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if !m.isLocal(member) {
+					m.observeLeader(member)
+					m.observeInSync(member)
+					m.observeConfig(member)
+				}
+				m.publish(api.MemberEventType_MEMBER_UPDATE, member)
+			}
 		case serf.EventMemberLeave, serf.EventMemberFailed:
+			typ := api.MemberEventType_MEMBER_LEAVE
+			if e.EventType() == serf.EventMemberFailed {
+				typ = api.MemberEventType_MEMBER_FAIL
+			}
 			for _, member := range e.(serf.MemberEvent).Members {
+				m.publish(typ, member)
 				if m.isLocal(member) {
 					continue
 				}
-
+				m.observeFailure(member)
 				m.handleLeave(member)
 			}
-
+		case serf.EventUser:
+			if e := e.(serf.UserEvent); e.Name == configEvent {
+				m.handleConfigEvent(e)
+			}
+		case serf.EventQuery:
+			if q := e.(*serf.Query); q.Name == configQuery {
+				m.handleConfigQuery(q)
+			}
 		}
 	}
 }
@@ -109,6 +241,7 @@ func (m *Membership) isLocal(member serf.Member) bool {
 }
 
 func (m *Membership) Leave() error {
+	m.leaveOnce.Do(func() { close(m.left) })
 	return m.serf.Leave()
 }
 
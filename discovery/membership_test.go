@@ -1,13 +1,19 @@
 package discovery
 
 import (
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 	"time"
 
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
 	"github.com/hashicorp/serf/serf"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestMembership(t *testing.T) {
@@ -31,6 +37,188 @@ func TestMembership(t *testing.T) {
 	require.Equal(t, fmt.Sprintf("%d", 2), <-handler.leaves)
 }
 
+func TestLeadership(t *testing.T) {
+	m, _ := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+	leaderIs := func(name string, epoch uint64) func() bool {
+		return func() bool {
+			for _, member := range m {
+				leader, _, e := member.Leader()
+				if leader != name || e != epoch {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	require.Eventually(t, leaderIs("0", 1), 3*time.Second, 250*time.Millisecond)
+	require.True(t, m[0].IsLeader())
+
+	require.NoError(t, m[2].TransferLeadership("1"))
+	require.Eventually(t, leaderIs("1", 2), 3*time.Second, 250*time.Millisecond)
+	require.True(t, m[1].IsLeader())
+	require.False(t, m[0].IsLeader())
+
+	require.Error(t, m[0].TransferLeadership("unknown"))
+}
+
+func TestFailover(t *testing.T) {
+	var m []*Membership
+	offsets := []uint64{5, 3, 5}
+	for i, next := range offsets {
+		next := next
+		addr := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+		c := Config{
+			NodeName:        fmt.Sprintf("%d", i),
+			BindAddr:        addr,
+			Tags:            map[string]string{"rpc_addr": addr},
+			NextOffset:      func() uint64 { return next },
+			FailoverTimeout: 500 * time.Millisecond,
+		}
+		if i == 0 {
+			c.Bootstrap = true
+		} else {
+			c.StartJoinAddrs = []string{m[0].BindAddr}
+		}
+		member, err := New(&handler{}, c)
+		require.NoError(t, err)
+		m = append(m, member)
+	}
+	leaderIs := func(name string, epoch uint64, members ...*Membership) func() bool {
+		return func() bool {
+			for _, member := range members {
+				leader, _, e := member.Leader()
+				if leader != name || e != epoch {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	require.Eventually(t, leaderIs("0", 1, m...), 3*time.Second, 250*time.Millisecond)
+	require.NoError(t, m[0].SetInSync([]string{"1", "2"}))
+	require.Eventually(t, func() bool {
+		for _, member := range m[1:] {
+			member.mu.Lock()
+			inSync := member.leaderInSync
+			member.mu.Unlock()
+			if !contains(inSync, "2") {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 250*time.Millisecond)
+
+	// the in-sync voter holding the most records takes over
+	require.NoError(t, m[0].Leave())
+	require.Eventually(t, leaderIs("2", 2, m[1:]...), 5*time.Second, 250*time.Millisecond)
+	require.Error(t, m[1].AppointLeader("1"))
+
+	// without in-sync voters to take over a leader has to be appointed
+	require.NoError(t, m[2].Leave())
+	time.Sleep(time.Second)
+	require.True(t, leaderIs("2", 2, m[1])())
+	require.NoError(t, m[1].AppointLeader("1"))
+	require.True(t, leaderIs("1", 3, m[1])())
+}
+
+func TestNonVoter(t *testing.T) {
+	m, _ := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+
+	addr := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+	nonVoter, err := New(&handler{}, Config{
+		NodeName:       "2",
+		BindAddr:       addr,
+		Tags:           map[string]string{"rpc_addr": addr},
+		StartJoinAddrs: []string{m[0].BindAddr},
+		NonVoter:       true,
+		Zone:           "b",
+	})
+	require.NoError(t, err)
+	m = append(m, nonVoter)
+
+	require.Eventually(t, func() bool {
+		servers, err := m[0].GetServers()
+		require.NoError(t, err)
+		return len(servers) == 3 && servers[2].Role == api.Role_ROLE_NON_VOTER
+	}, 3*time.Second, 250*time.Millisecond)
+
+	servers, err := m[0].GetServers()
+	require.NoError(t, err)
+	require.True(t, servers[0].IsLeader)
+	require.Equal(t, api.Role_ROLE_VOTER, servers[0].Role)
+	require.Equal(t, api.Role_ROLE_VOTER, servers[1].Role)
+	require.Equal(t, addr, servers[2].RpcAddr)
+	require.Equal(t, "b", servers[2].Zone)
+	require.Equal(t, "b", m[0].ZoneOf("2"))
+	require.Equal(t, "", m[0].ZoneOf("1"))
+
+	require.True(t, m[0].IsVoter("1"))
+	require.False(t, m[0].IsVoter("2"))
+	require.Error(t, m[0].TransferLeadership("2"))
+	require.NoError(t, m[0].TransferLeadership("1"))
+}
+
+func TestKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldKey, newKey := make([]byte, 16), make([]byte, 32)
+	for i := range newKey {
+		newKey[i] = byte(i)
+	}
+	encode := base64.StdEncoding.EncodeToString
+
+	newMember := func(name string, key []byte, join []string) (*Membership, error) {
+		addr := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+		return New(&handler{}, Config{
+			NodeName:       name,
+			BindAddr:       addr,
+			Tags:           map[string]string{"rpc_addr": addr},
+			StartJoinAddrs: join,
+			EncryptKey:     key,
+			KeyringFile:    path.Join(dir, name+".keyring"),
+		})
+	}
+	m0, err := newMember("0", oldKey, nil)
+	require.NoError(t, err)
+	m1, err := newMember("1", oldKey, []string{m0.BindAddr})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(m0.Members()) == 2
+	}, 3*time.Second, 250*time.Millisecond)
+
+	// a host without the key can't join
+	_, err = newMember("plain", nil, []string{m0.BindAddr})
+	require.Error(t, err)
+
+	res, err := m0.InstallKey(encode(newKey))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), res.Responses)
+	_, err = m1.UseKey(encode(newKey))
+	require.NoError(t, err)
+	_, err = m0.RemoveKey(encode(oldKey))
+	require.NoError(t, err)
+
+	res, err = m1.ListKeys()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int32{encode(newKey): 2}, res.Keys)
+	require.Equal(t, map[string]int32{encode(newKey): 2}, res.PrimaryKeys)
+
+	// the rotation survives a restart even though the member is still
+	// configured with the old key
+	require.NoError(t, m1.Leave())
+	m1, err = newMember("1", oldKey, []string{m0.BindAddr})
+	require.NoError(t, err)
+	_, err = newMember("2", newKey, []string{m0.BindAddr})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(m1.Members()) >= 3
+	}, 3*time.Second, 250*time.Millisecond)
+}
+
 //setupMember() sets up a new member under a free port and with the member’s
 //length as the node name so the names are unique
 func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler) {
@@ -54,6 +242,7 @@ func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler)
 	h := &handler{}
 
 	if len(members) == 0 {
+		c.Bootstrap = true
 		h.joins = make(chan map[string]string, 3)
 		h.leaves = make(chan string, 3)
 	} else {
@@ -91,3 +280,251 @@ func (h handler) Leave(id string) error {
 
 	return nil
 }
+
+func TestClusterID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	newMember := func(name string, c Config) (*Membership, error) {
+		addr := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+		c.NodeName = name
+		c.BindAddr = addr
+		c.Tags = map[string]string{"rpc_addr": addr}
+		c.IDFile = path.Join(dir, name+".id")
+		return New(&handler{}, c)
+	}
+	m0, err := newMember("0", Config{Bootstrap: true})
+	require.NoError(t, err)
+	require.NotEmpty(t, m0.ClusterID())
+	m1, err := newMember("1", Config{StartJoinAddrs: []string{m0.BindAddr}})
+	require.NoError(t, err)
+	// a new member adopts the cluster's id
+	require.Equal(t, m0.ClusterID(), m1.ClusterID())
+	require.NotEqual(t, m0.NodeID(), m1.NodeID())
+
+	// a member of another cluster can't join
+	other, err := newMember("other", Config{Bootstrap: true})
+	require.NoError(t, err)
+	_, err = newMember("2", Config{
+		ClusterID:      other.ClusterID(),
+		StartJoinAddrs: []string{m0.BindAddr},
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "belongs to cluster")
+	require.NoError(t, other.Leave())
+
+	// the ids survive a restart, and the member can't be restarted into
+	// another cluster
+	nodeID := m1.NodeID()
+	require.NoError(t, m1.Leave())
+	_, err = newMember("1", Config{ClusterID: "other"})
+	require.Error(t, err)
+	m1, err = newMember("1", Config{})
+	require.NoError(t, err)
+	require.Equal(t, m0.ClusterID(), m1.ClusterID())
+	require.Equal(t, nodeID, m1.NodeID())
+}
+
+func TestWatch(t *testing.T) {
+	m, _ := setupMember(t, nil)
+	events, cancel := m[0].Watch(true)
+	defer cancel()
+	// next returns the next event of the named member that isn't a tag
+	// change
+	next := func(id string) *api.MemberEvent {
+		for {
+			select {
+			case event := <-events:
+				if event.Server.Id == id &&
+					event.Type != api.MemberEventType_MEMBER_UPDATE {
+					return event
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("no member event")
+			}
+		}
+	}
+	event := next("0")
+	require.Equal(t, api.MemberEventType_MEMBER_JOIN, event.Type)
+	require.True(t, event.Server.IsLeader)
+
+	m, _ = setupMember(t, m)
+	event = next("1")
+	require.Equal(t, api.MemberEventType_MEMBER_JOIN, event.Type)
+	require.Equal(t, m[1].BindAddr, event.Tags["rpc_addr"])
+
+	require.NoError(t, m[1].Leave())
+	require.Equal(t, api.MemberEventType_MEMBER_LEAVE, next("1").Type)
+}
+
+func TestSeeds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seeds-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, _ := setupMember(t, nil)
+	file := &FileSeeds{Path: path.Join(dir, "peers")}
+	require.NoError(t, ioutil.WriteFile(file.Path, []byte(
+		"# seeds\n\n"+m[0].BindAddr+"\n",
+	), 0644))
+	seeds, err := file.Seeds()
+	require.NoError(t, err)
+	require.Equal(t, []string{m[0].BindAddr}, seeds)
+
+	seeds, err = (&DNSSeeds{Name: "localhost", Port: 8401}).Seeds()
+	require.NoError(t, err)
+	require.Contains(t, seeds, "127.0.0.1:8401")
+
+	newMember := func(name string, seeds SeedProvider) *Membership {
+		addr := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+		member, err := New(&handler{}, Config{
+			NodeName:       name,
+			BindAddr:       addr,
+			Tags:           map[string]string{"rpc_addr": addr},
+			Seeds:          []SeedProvider{seeds},
+			RejoinInterval: 100 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		return member
+	}
+	m1 := newMember("1", file)
+	require.Eventually(t, func() bool {
+		return len(m1.Members()) == 2
+	}, 3*time.Second, 100*time.Millisecond)
+
+	// a member started before its seeds are listed finds the cluster once
+	// they are
+	later := &FileSeeds{Path: path.Join(dir, "later")}
+	require.NoError(t, ioutil.WriteFile(later.Path, nil, 0644))
+	m2 := newMember("2", later)
+	require.Equal(t, 1, len(m2.Members()))
+	require.NoError(t, ioutil.WriteFile(later.Path, []byte(m1.BindAddr), 0644))
+	require.Eventually(t, func() bool {
+		return len(m2.Members()) == 3
+	}, 3*time.Second, 100*time.Millisecond)
+
+	// nor does one whose seeds are listed but down
+	down := &FileSeeds{Path: path.Join(dir, "down")}
+	addr := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+	require.NoError(t, ioutil.WriteFile(down.Path, []byte(addr), 0644))
+	m3 := newMember("3", down)
+	require.Equal(t, 1, len(m3.Members()))
+	require.NoError(t, ioutil.WriteFile(down.Path, []byte(m1.BindAddr), 0644))
+	require.Eventually(t, func() bool {
+		return len(m3.Members()) == 4
+	}, 3*time.Second, 100*time.Millisecond)
+}
+
+func TestClusterConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster-config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	applied := make(chan *api.ClusterConfig, 10)
+	newMember := func(name string, join []string) *Membership {
+		addr := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+		member, err := New(&handler{}, Config{
+			NodeName:       name,
+			BindAddr:       addr,
+			Tags:           map[string]string{"rpc_addr": addr},
+			StartJoinAddrs: join,
+			ApplyClusterConfig: func(c *api.ClusterConfig) {
+				if name == "2" {
+					applied <- c
+				}
+			},
+			ClusterConfigFile: path.Join(dir, name+".config"),
+		})
+		require.NoError(t, err)
+		return member
+	}
+	m0 := newMember("0", nil)
+	m1 := newMember("1", []string{m0.BindAddr})
+
+	c, err := m1.SetClusterConfig(&api.ClusterConfig{MaxHeaders: 8})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), c.Version)
+	require.Equal(t, "1", c.Origin)
+	require.Eventually(t, func() bool {
+		return m0.ClusterConfig().MaxHeaders == 8
+	}, 3*time.Second, 100*time.Millisecond)
+
+	// a change made against an older config is refused
+	_, err = m0.SetClusterConfig(&api.ClusterConfig{MaxHeaders: 4})
+	require.Equal(t, api.ErrStaleConfig{Version: 0, Current: 1}, err)
+
+	// acl rules aren't trusted over unencrypted gossip
+	_, err = m0.SetClusterConfig(&api.ClusterConfig{
+		Version: 1,
+		Acl:     []*api.AclRule{{Subject: "nobody", Object: "*", Action: "produce"}},
+	})
+	require.Equal(t, api.ErrUntrustedACL{Member: "0"}, err)
+
+	// a member joining after the change fetches it
+	m2 := newMember("2", []string{m0.BindAddr})
+	select {
+	case c = <-applied:
+		require.Equal(t, uint32(8), c.MaxHeaders)
+	case <-time.After(3 * time.Second):
+		t.Fatal("config not applied")
+	}
+	require.Eventually(t, func() bool {
+		versions := m0.ConfigVersions()
+		return len(versions) == 3 &&
+			versions["0"] == 1 && versions["1"] == 1 && versions["2"] == 1
+	}, 3*time.Second, 100*time.Millisecond)
+
+	// and keeps it through a restart
+	require.NoError(t, m2.Leave())
+	m2 = newMember("2", nil)
+	require.Equal(t, uint64(1), (<-applied).Version)
+	require.Equal(t, uint32(8), m2.ClusterConfig().MaxHeaders)
+}
+
+func TestClusterConfigACL(t *testing.T) {
+	key := make([]byte, 16)
+	newMember := func(name string, join []string) *Membership {
+		addr := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+		member, err := New(&handler{}, Config{
+			NodeName:       name,
+			BindAddr:       addr,
+			Tags:           map[string]string{"rpc_addr": addr},
+			StartJoinAddrs: join,
+			Bootstrap:      join == nil,
+			EncryptKey:     key,
+		})
+		require.NoError(t, err)
+		return member
+	}
+	m0 := newMember("0", nil)
+	m1 := newMember("1", []string{m0.BindAddr})
+	require.Eventually(t, func() bool {
+		leader, _, _ := m1.Leader()
+		return leader == "0"
+	}, 3*time.Second, 100*time.Millisecond)
+
+	acl := []*api.AclRule{{Subject: "nobody", Object: "*", Action: "produce"}}
+	_, err := m1.SetClusterConfig(&api.ClusterConfig{Acl: acl})
+	require.Equal(t, api.ErrUntrustedACL{Member: "1"}, err)
+	_, err = m0.SetClusterConfig(&api.ClusterConfig{Acl: acl})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(m1.ClusterConfig().Acl) == 1
+	}, 3*time.Second, 100*time.Millisecond)
+
+	// a member that isn't the leader can't forge a change
+	forged, err := proto.Marshal(&api.ClusterConfig{Version: 2, Origin: "1"})
+	require.NoError(t, err)
+	require.NoError(t, m1.serf.UserEvent(configEvent, forged, false))
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, uint64(1), m0.ClusterConfig().Version)
+	require.Len(t, m0.ClusterConfig().Acl, 1)
+
+	// a member joining after the leader changed fetches the rules from it
+	require.NoError(t, m0.TransferLeadership("1"))
+	m2 := newMember("2", []string{m0.BindAddr})
+	require.Eventually(t, func() bool {
+		return len(m2.ClusterConfig().Acl) == 1
+	}, 3*time.Second, 100*time.Millisecond)
+}
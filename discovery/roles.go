@@ -0,0 +1,56 @@
+package discovery
+
+import (
+	"sort"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"github.com/hashicorp/serf/serf"
+)
+
+// Non-voters carry a role tag. Members without it vote, including those
+// started before roles existed.
+const (
+	roleTag      = "role"
+	roleNonVoter = "non_voter"
+)
+
+// IsVoter reports whether the named member votes, unknown members don't.
+func (m *Membership) IsVoter(name string) bool {
+	for _, member := range m.serf.Members() {
+		if member.Name == name {
+			return member.Tags[roleTag] != roleNonVoter
+		}
+	}
+	return false
+}
+
+// GetServers returns the alive members with their role and zone, and which
+// of them leads.
+func (m *Membership) GetServers() ([]*api.Server, error) {
+	leader, _, _ := m.Leader()
+	var servers []*api.Server
+	for _, member := range m.serf.Members() {
+		if member.Status != serf.StatusAlive {
+			continue
+		}
+		servers = append(servers, toServer(member, leader))
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Id < servers[j].Id
+	})
+	return servers, nil
+}
+
+func toServer(member serf.Member, leader string) *api.Server {
+	role := api.Role_ROLE_VOTER
+	if member.Tags[roleTag] == roleNonVoter {
+		role = api.Role_ROLE_NON_VOTER
+	}
+	return &api.Server{
+		Id:       member.Name,
+		RpcAddr:  member.Tags["rpc_addr"],
+		IsLeader: member.Name == leader,
+		Role:     role,
+		Zone:     member.Tags[zoneTag],
+	}
+}
@@ -0,0 +1,174 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// defaultRejoinInterval is how often seeds are resolved again when the
+// config doesn't say.
+const defaultRejoinInterval = 30 * time.Second
+
+// SeedProvider resolves the addresses of members to join, as host:port
+// strings. It's asked again every rejoin interval, so it should reflect
+// the members running now.
+type SeedProvider interface {
+	Seeds() ([]string, error)
+}
+
+// DNSSeeds resolves members from DNS, such as a headless service's
+// records. A name starting with an underscore, like
+// _serf._tcp.log.default.svc, is looked up as SRV records giving each
+// member's host and port. Other names are looked up as A and AAAA records,
+// each member listening on Port.
+type DNSSeeds struct {
+	Name string
+	Port int
+	// Resolver looks the records up, it defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+	// Timeout bounds a lookup, it defaults to 5s.
+	Timeout time.Duration
+}
+
+func (d *DNSSeeds) Seeds() ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var seeds []string
+	if strings.HasPrefix(d.Name, "_") {
+		_, records, err := resolver.LookupSRV(ctx, "", "", d.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			seeds = append(seeds, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+		return seeds, nil
+	}
+	hosts, err := resolver.LookupHost(ctx, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		seeds = append(seeds, net.JoinHostPort(host, strconv.Itoa(d.Port)))
+	}
+	return seeds, nil
+}
+
+// FileSeeds polls a file listing a member's host:port on every line.
+// Blank lines and lines starting with # are skipped. The file is read
+// each time seeds are resolved, once every rejoin interval, rather than
+// watched for changes, so an edit takes up to an interval to be seen and
+// one that's undone within an interval may never be.
+type FileSeeds struct {
+	Path string
+}
+
+func (f *FileSeeds) Seeds() ([]string, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var seeds []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		seeds = append(seeds, line)
+	}
+	return seeds, scanner.Err()
+}
+
+// resolveSeeds returns the addresses every seed provider resolves. It only
+// fails if none of them resolved.
+func (m *Membership) resolveSeeds() ([]string, error) {
+	var seeds []string
+	var err error
+	resolved := false
+	for _, provider := range m.Seeds {
+		s, e := provider.Seeds()
+		if e != nil {
+			err = e
+			continue
+		}
+		resolved = true
+		seeds = append(seeds, s...)
+	}
+	if !resolved {
+		return nil, err
+	}
+	return seeds, nil
+}
+
+// rejoin resolves the seeds every rejoin interval and joins the ones that
+// aren't alive members, so a member that lost the cluster, or was started
+// while the seeds were down, finds it again once they're back.
+func (m *Membership) rejoin() {
+	interval := m.RejoinInterval
+	if interval == 0 {
+		interval = defaultRejoinInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.left:
+			return
+		case <-ticker.C:
+		}
+		seeds, err := m.resolveSeeds()
+		if err != nil {
+			m.logger.Error("failed to resolve seeds", zap.Error(err))
+			continue
+		}
+		seeds = m.unknown(seeds)
+		if len(seeds) == 0 {
+			continue
+		}
+		if _, err = m.serf.Join(seeds, true); err != nil {
+			m.logger.Error(
+				"failed to join seeds",
+				zap.Error(err),
+				zap.Strings("seeds", seeds),
+			)
+		}
+	}
+}
+
+// unknown drops the seeds at alive members' addresses.
+func (m *Membership) unknown(seeds []string) []string {
+	alive := make(map[string]bool)
+	for _, member := range m.serf.Members() {
+		if member.Status == serf.StatusAlive {
+			alive[net.JoinHostPort(member.Addr.String(), strconv.Itoa(int(member.Port)))] = true
+		}
+	}
+	var unknown []string
+	for _, seed := range seeds {
+		addr, err := net.ResolveTCPAddr("tcp", seed)
+		if err == nil && alive[addr.String()] {
+			continue
+		}
+		unknown = append(unknown, seed)
+	}
+	return unknown
+}
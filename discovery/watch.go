@@ -0,0 +1,75 @@
+package discovery
+
+import (
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"github.com/hashicorp/serf/serf"
+)
+
+// watchBuffer is how many events a watcher may fall behind by before it's
+// dropped.
+const watchBuffer = 64
+
+// Watch returns a channel receiving an event for every member joining,
+// leaving, failing or changing its tags, the local member included, and a
+// func to stop watching. With current it first receives a join event for
+// every member already in the cluster.
+//
+// Events are never waited on: a watcher falling behind has its channel
+// closed and must watch again.
+func (m *Membership) Watch(current bool) (<-chan *api.MemberEvent, func()) {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	var members []serf.Member
+	if current {
+		members = m.serf.Members()
+	}
+	events := make(chan *api.MemberEvent, len(members)+watchBuffer)
+	leader, _, _ := m.Leader()
+	for _, member := range members {
+		if member.Status == serf.StatusAlive {
+			events <- toEvent(api.MemberEventType_MEMBER_JOIN, member, leader)
+		}
+	}
+	if m.watchers == nil {
+		m.watchers = make(map[chan *api.MemberEvent]struct{})
+	}
+	m.watchers[events] = struct{}{}
+	return events, func() {
+		m.watchMu.Lock()
+		defer m.watchMu.Unlock()
+		if _, ok := m.watchers[events]; ok {
+			delete(m.watchers, events)
+			close(events)
+		}
+	}
+}
+
+// publish passes the member's event on to every watcher.
+func (m *Membership) publish(typ api.MemberEventType, member serf.Member) {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	if len(m.watchers) == 0 {
+		return
+	}
+	leader, _, _ := m.Leader()
+	for events := range m.watchers {
+		select {
+		case events <- toEvent(typ, member, leader):
+		default:
+			delete(m.watchers, events)
+			close(events)
+		}
+	}
+}
+
+func toEvent(typ api.MemberEventType, member serf.Member, leader string) *api.MemberEvent {
+	tags := make(map[string]string, len(member.Tags))
+	for k, v := range member.Tags {
+		tags[k] = v
+	}
+	return &api.MemberEvent{
+		Type:   typ,
+		Server: toServer(member, leader),
+		Tags:   tags,
+	}
+}
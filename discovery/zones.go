@@ -0,0 +1,16 @@
+package discovery
+
+// zoneTag carries the zone a member runs in. Members without it are in no
+// zone.
+const zoneTag = "zone"
+
+// ZoneOf returns the zone the named member runs in, empty when it has none or
+// isn't known.
+func (m *Membership) ZoneOf(name string) string {
+	for _, member := range m.serf.Members() {
+		if member.Name == name {
+			return member.Tags[zoneTag]
+		}
+	}
+	return ""
+}
@@ -1,16 +1,26 @@
 package agent
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
+	"path"
+	"strconv"
 	"sync"
+	"time"
 
 	api "github.com/abdulmajid18/log-distributed-system/api/v1"
 	"github.com/abdulmajid18/log-distributed-system/discovery"
 	"github.com/abdulmajid18/log-distributed-system/internal/auth"
+	"github.com/abdulmajid18/log-distributed-system/internal/chain"
 	"github.com/abdulmajid18/log-distributed-system/internal/log"
+	"github.com/abdulmajid18/log-distributed-system/internal/mirror"
+	"github.com/abdulmajid18/log-distributed-system/internal/placement"
 	"github.com/abdulmajid18/log-distributed-system/internal/server"
+	"go.opencensus.io/stats/view"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -26,14 +36,109 @@ type Config struct {
 	StartJoinAddrs  []string
 	ACLModelFile    string
 	ACLModelPolicy  string
+	// MinInSyncReplicas is how many nodes must hold a record before an
+	// ACKS_ALL produce succeeds.
+	MinInSyncReplicas int
+	// MultiWriter lets every node accept writes, replicating each record
+	// from the node it was produced on. Otherwise records are expected to
+	// be produced on a single node and keep their offsets everywhere.
+	MultiWriter bool
+	// MaxReplicaLagTime and MaxReplicaLagOffsets bound how far a follower
+	// may fall behind before it drops out of the in-sync replica set.
+	MaxReplicaLagTime    time.Duration
+	MaxReplicaLagOffsets uint64
+	// ReadLease is how recently the in-sync replicas must have acknowledged
+	// the leader for it to serve linearizable reads, and how long a replica
+	// waits before acknowledging a new leader.
+	ReadLease time.Duration
+	// VerifyReplicas compares the local log with the server it replicates
+	// from on connecting, the leader or the node before it in a chain, and
+	// RepairReplicas also truncates the local log where it diverged so the
+	// records are fetched again. The leader is never repaired.
+	VerifyReplicas bool
+	RepairReplicas bool
+	// Bootstrap makes the node the cluster's first leader. Unless
+	// MultiWriter is set only the leader accepts writes, so a voter with
+	// no nodes to join bootstraps a cluster of its own by default. When
+	// the leader fails an in-sync voter takes over.
+	Bootstrap bool
+	// NonVoter makes the node a read replica: it replicates the log and
+	// serves reads, but never counts towards the in-sync replicas
+	// acknowledging writes and never leads.
+	NonVoter bool
+	// Zone is the rack or availability zone the node runs in. ACKS_ALL
+	// produces wait for the record to be held in MinInSyncZones zones, so
+	// losing a zone doesn't lose acknowledged records.
+	Zone           string
+	MinInSyncZones int
+	// Partitions is how many partitions the leader assigns to the cluster's
+	// servers, each held by ReplicationFactor of them. No partitions are
+	// assigned when it's zero. The leader appends every assignment to the
+	// log as a control record, so the next leader carries on from it.
+	Partitions        int
+	ReplicationFactor int
+	// MirrorFrom is the RPC address of a server in another cluster whose
+	// log is mirrored into this node's cluster, dialed with the peer TLS
+	// config. Mirror a single node of the cluster, its leader unless every
+	// node accepts writes. MirrorTopics limits the topics mirrored, every
+	// topic is when it's empty.
+	MirrorFrom   string
+	MirrorTopics []string
+	// EncryptKey is the base64 encoded key gossip is encrypted with, so
+	// only nodes holding it can join. KeyringFile is where the node keeps
+	// the keys installed since, so rotations survive restarts.
+	EncryptKey  string
+	KeyringFile string
+	// ClusterID is the cluster the node must join. The node keeps the id
+	// of its cluster in DataDir, picked by the bootstrap node or adopted
+	// from the cluster it first joins, and refuses to join any other.
+	ClusterID string
+	// JoinDNS and JoinFile find nodes to join besides StartJoinAddrs.
+	// JoinDNS names DNS records, such as a headless service's: SRV records
+	// when it starts with an underscore, otherwise A and AAAA records of
+	// nodes binding the same port as this one. JoinFile lists a host:port
+	// on every line. Both are resolved again every RejoinInterval, so the
+	// node finds the cluster again once restarted seeds are back, and a
+	// node started before its seeds still joins them. JoinFile is polled
+	// rather than watched, so edits take up to RejoinInterval to apply.
+	JoinDNS        string
+	JoinFile       string
+	RejoinInterval time.Duration
+	// ChainReplication replicates along a chain of the voters, from the
+	// leader at its head to a tail that acknowledges writes and serves
+	// consistent reads, instead of every node replicating from every
+	// other. It needs a single writer.
+	ChainReplication bool
 }
 
+// idFile is the file in the data dir holding the node's cluster and node
+// ids, and clusterConfigFile the cluster config it applied. logDir is the
+// directory holding the log, which installing a snapshot replaces whole.
+const (
+	idFile            = "cluster.id"
+	clusterConfigFile = "cluster.config"
+	logDir            = "log"
+	// inSyncInterval is how often the leader gossips its in-sync replicas
+	inSyncInterval = time.Second
+)
+
 type Agent struct {
 	Config
 	log        *log.Log
 	server     *grpc.Server
 	membership *discovery.Membership
 	replicator *log.Replicator
+	replicas   *log.ReplicaTracker
+	txns       *log.TxnCoordinator
+	controller *placement.Controller
+	chain      *chain.Chain
+	mirror     *mirror.Mirror
+	// stopMirror stops the mirror and waits for it to checkpoint
+	stopMirror func() error
+
+	// mu guards membership for the controller, which hears of members
+	// joining before the membership is set up
+	mu sync.Mutex
 
 	shutdown     bool
 	shutdowns    chan struct{}
@@ -49,6 +154,17 @@ func (c Config) RPCAddr() (string, error) {
 }
 
 func New(config Config) (*Agent, error) {
+	if config.Bootstrap && config.NonVoter {
+		return nil, errors.New("a non-voter can't bootstrap the cluster")
+	}
+	if config.ChainReplication && config.MultiWriter {
+		return nil, errors.New("chain replication needs a single writer")
+	}
+	if !config.MultiWriter && !config.NonVoter &&
+		len(config.StartJoinAddrs) == 0 &&
+		config.JoinDNS == "" && config.JoinFile == "" {
+		config.Bootstrap = true
+	}
 	agent := &Agent{
 		Config:    config,
 		shutdowns: make(chan struct{}),
@@ -57,8 +173,11 @@ func New(config Config) (*Agent, error) {
 	setup := []func() error{
 		agent.setupLogger,
 		agent.setupLog,
-		agent.setupServer,
+		// the server needs the membership for leadership, replicas
+		// retry until it's serving
 		agent.setupMembership,
+		agent.setupMirror,
+		agent.setupServer,
 	}
 
 	for _, fn := range setup {
@@ -66,6 +185,9 @@ func New(config Config) (*Agent, error) {
 			return nil, err
 		}
 	}
+	if !config.MultiWriter {
+		go agent.gossipInSync()
+	}
 
 	return agent, nil
 }
@@ -81,8 +203,15 @@ func (a *Agent) setupLogger() error {
 }
 
 func (a *Agent) setupLog() error {
+	// logs used to be kept in the data dir itself
+	dir := path.Join(a.DataDir, logDir)
+	if err := log.MoveLog(a.DataDir, dir); err != nil {
+		return err
+	}
 	var err error
-	a.log, err = log.NewLog(a.DataDir, log.Config{})
+	c := log.Config{}
+	c.Origin = a.Config.NodeName
+	a.log, err = log.NewLog(dir, c)
 	return err
 }
 
@@ -96,36 +225,288 @@ func (a *Agent) setupMembership() error {
 		creds := credentials.NewTLS(a.Config.PeerTLSConfig)
 		opts = append(opts, grpc.WithTransportCredentials(creds))
 	}
-	conn, err := grpc.Dial(addr, opts...)
+
+	a.replicator = &log.Replicator{
+		DialOptions: opts,
+		Log:         a.log,
+		NodeName:    a.Config.NodeName,
+		DataDir:     a.Config.DataDir,
+		MultiWriter: a.Config.MultiWriter,
+		Verify:      a.Config.VerifyReplicas,
+		Repair:      a.Config.RepairReplicas,
+		Lease:       a.Config.ReadLease,
+	}
+
+	encryptKey, err := base64.StdEncoding.DecodeString(a.Config.EncryptKey)
+	if err != nil {
+		return fmt.Errorf("invalid encrypt key: %w", err)
+	}
+
+	seeds, err := a.seeds()
 	if err != nil {
 		return err
 	}
-	client := api.NewLogClient(conn)
 
-	replicator := &log.Replicator{
-		LocalServer: client,
-		DialOptions: opts,
+	h := handlers{a.replicator}
+	if a.Config.Partitions > 0 {
+		a.controller = &placement.Controller{
+			Partitions:        a.Config.Partitions,
+			ReplicationFactor: a.Config.ReplicationFactor,
+			Servers:           a.servers,
+			Load:              a.log.Assignment,
+			Save:              a.saveAssignment,
+		}
+		h = append(h, a.controller)
+	}
+	if a.Config.ChainReplication {
+		a.chain = &chain.Chain{
+			NodeName: a.Config.NodeName,
+			Servers:  a.servers,
+		}
+		a.replicator.Chain = a.chain
+		h = append(h, a.chain)
+	} else if !a.Config.MultiWriter {
+		a.replicator.Leader = a.leader
+	}
+	var handler discovery.Handler = a.replicator
+	if len(h) > 1 {
+		handler = h
 	}
 
-	a.membership, err = discovery.New(replicator, discovery.Config{
+	membership, err := discovery.New(handler, discovery.Config{
 		NodeName: a.Config.NodeName,
 		BindAddr: a.Config.BindAddr,
 		Tags: map[string]string{
 			"rpc_addr": addr,
 		},
 		StartJoinAddrs: a.Config.StartJoinAddrs,
+		Bootstrap:      a.Config.Bootstrap,
+		NonVoter:       a.Config.NonVoter,
+		Zone:           a.Config.Zone,
+		EncryptKey:     encryptKey,
+		KeyringFile:    a.Config.KeyringFile,
+		ClusterID:      a.Config.ClusterID,
+		IDFile:         path.Join(a.Config.DataDir, idFile),
+		Seeds:          seeds,
+		RejoinInterval: a.Config.RejoinInterval,
+		NextOffset:     a.log.NextOffset,
+		// the server reads the rest of the config as it needs it
+		ApplyClusterConfig: func(c *api.ClusterConfig) {
+			a.log.SetSegmentLimits(c.MaxSegmentStoreBytes, c.MaxSegmentIndexBytes)
+			a.log.SetRetention(c.RetentionBytes)
+		},
+		ClusterConfigFile: path.Join(a.Config.DataDir, clusterConfigFile),
 	})
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.membership = membership
+	a.mu.Unlock()
+	if a.controller != nil {
+		return a.controller.Reconcile()
+	}
+	return nil
+}
 
+// seeds returns the providers of the nodes to join.
+func (a *Agent) seeds() ([]discovery.SeedProvider, error) {
+	var seeds []discovery.SeedProvider
+	if a.Config.JoinDNS != "" {
+		_, port, err := net.SplitHostPort(a.Config.BindAddr)
+		if err != nil {
+			return nil, err
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, &discovery.DNSSeeds{Name: a.Config.JoinDNS, Port: p})
+	}
+	if a.Config.JoinFile != "" {
+		seeds = append(seeds, &discovery.FileSeeds{Path: a.Config.JoinFile})
+	}
+	return seeds, nil
+}
+
+// servers lists the cluster's servers once the membership is set up.
+func (a *Agent) servers() ([]*api.Server, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.membership == nil {
+		return nil, nil
+	}
+	return a.membership.GetServers()
+}
+
+// leader names the cluster's leader once the membership is set up.
+func (a *Agent) leader() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.membership == nil {
+		return ""
+	}
+	name, _, _ := a.membership.Leader()
+	return name
+}
+
+// gossipInSync gossips the in-sync replicas while the node leads, so one
+// of them takes over if it fails.
+func (a *Agent) gossipInSync() {
+	ticker := time.NewTicker(inSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.shutdowns:
+			return
+		case <-ticker.C:
+		}
+		if !a.membership.IsLeader() {
+			continue
+		}
+		if err := a.membership.SetInSync(a.replicas.InSync()); err != nil {
+			zap.L().Error("failed to gossip in-sync replicas", zap.Error(err))
+		}
+	}
+}
+
+// saveAssignment appends the assignment to the log if this node leads.
+// Other nodes' controllers only follow what the leader appended, their own
+// assignments are dropped.
+func (a *Agent) saveAssignment(assignment *api.Assignment) error {
+	if a.leader() != a.Config.NodeName {
+		return nil
+	}
+	return a.log.AppendAssignment(assignment)
+}
+
+// handlers passes membership events on to every handler, returning the
+// first error any of them failed with.
+type handlers []discovery.Handler
+
+func (h handlers) Join(name, addr string) error {
+	var err error
+	for _, handler := range h {
+		if e := handler.Join(name, addr); e != nil && err == nil {
+			err = e
+		}
+	}
 	return err
+}
 
+func (h handlers) Leave(name string) error {
+	var err error
+	for _, handler := range h {
+		if e := handler.Leave(name); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// setupMirror starts mirroring the other cluster's log into this one. The
+// mirror produces through this node's server, retrying until it's serving.
+func (a *Agent) setupMirror() error {
+	if a.Config.MirrorFrom == "" {
+		return nil
+	}
+	var opts []grpc.DialOption
+	if a.Config.PeerTLSConfig != nil {
+		creds := credentials.NewTLS(a.Config.PeerTLSConfig)
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	}
+	local, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+	source, err := grpc.Dial(a.Config.MirrorFrom, opts...)
+	if err != nil {
+		return err
+	}
+	// records are produced to the leader, the connection to it is only
+	// replaced once the leader changes. Only the mirror's goroutine uses
+	// it until it's stopped.
+	var target *grpc.ClientConn
+	var targetAddr string
+	a.mirror = &mirror.Mirror{
+		Source: api.NewLogClient(source),
+		Target: func() (api.LogClient, error) {
+			addr := local
+			if _, leader, _ := a.membership.Leader(); leader != "" && !a.Config.MultiWriter {
+				addr = leader
+			}
+			if target == nil || addr != targetAddr {
+				conn, err := grpc.Dial(addr, opts...)
+				if err != nil {
+					return nil, err
+				}
+				if target != nil {
+					target.Close()
+				}
+				target, targetAddr = conn, addr
+			}
+			return api.NewLogClient(target), nil
+		},
+		Dir:    a.Config.DataDir,
+		Topics: a.Config.MirrorTopics,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- a.mirror.Run(ctx)
+	}()
+	a.stopMirror = func() error {
+		cancel()
+		err := <-done
+		source.Close()
+		if target != nil {
+			target.Close()
+		}
+		return err
+	}
+	return nil
 }
 
 func (a *Agent) setupServer() error {
 	authorizer := auth.New(a.ACLModelFile, a.ACLModelPolicy)
+	a.replicas = &log.ReplicaTracker{
+		Log:           a.log,
+		MaxLagTime:    a.Config.MaxReplicaLagTime,
+		MaxLagOffsets: a.Config.MaxReplicaLagOffsets,
+		Voter:         a.membership.IsVoter,
+		Zone:          a.membership.ZoneOf,
+		LocalZone:     a.Config.Zone,
+		MinZones:      a.Config.MinInSyncZones,
+	}
+	if err := view.Register(log.ReplicaViews...); err != nil {
+		return err
+	}
+	a.txns = &log.TxnCoordinator{Log: a.log}
 
 	config := &server.Config{
-		CommitLog:  a.log,
-		Authorizer: authorizer,
+		CommitLog:         a.log,
+		Authorizer:        authorizer,
+		Replicas:          a.replicas,
+		Transactions:      a.txns,
+		MinInSyncReplicas: a.Config.MinInSyncReplicas,
+		ReadLease:         a.Config.ReadLease,
+		Membership:        a.membership,
+		GetServerer:       a.membership,
+		Keyring:           a.membership,
+		MemberWatcher:     a.membership,
+		ClusterConfig:     a.membership,
+	}
+	if !a.Config.MultiWriter {
+		config.Leadership = a.membership
+	}
+	if a.controller != nil {
+		config.Placement = a.controller
+	}
+	if a.chain != nil {
+		config.Chain = a.chain
+	}
+	if a.mirror != nil {
+		config.Mirror = a.mirror
 	}
 
 	var opts []grpc.ServerOption
@@ -161,6 +542,12 @@ func (a *Agent) setupServer() error {
 
 }
 
+// ReplicationStatus reports how replication from each peer is going, so
+// operators can see which peers aren't replicating.
+func (a *Agent) ReplicationStatus() []log.PeerStatus {
+	return a.replicator.Peers()
+}
+
 func (a *Agent) Shutdown() error {
 	a.shutDownLock.Lock()
 	defer a.shutDownLock.Unlock()
@@ -170,12 +557,19 @@ func (a *Agent) Shutdown() error {
 	a.shutdown = true
 	close(a.shutdowns)
 	shutdown := []func() error{
+		func() error {
+			if a.stopMirror == nil {
+				return nil
+			}
+			return a.stopMirror()
+		},
 		a.membership.Leave,
 		a.replicator.Close,
 		func() error {
 			a.server.GracefulStop()
 			return nil
 		},
+		a.txns.Close,
 		a.log.Close,
 	}
 	for _, fn := range shutdown {
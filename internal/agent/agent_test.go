@@ -4,8 +4,10 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 	"time"
 
@@ -15,10 +17,257 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 func Test(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, nil)
+	defer teardown()
+
+	time.Sleep(3 * time.Second)
+
+	//Single node produce and consume
+	leaderClient := client(t, agents[0], peerTLSConfig)
+	produceResponse, err := leaderClient.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{
+			Value: []byte("chicken wings"),
+		},
+	})
+
+	require.NoError(t, err)
+	consumeResponse, err := leaderClient.Consume(context.Background(), &api.ConsumeRequest{
+		Offset: 0,
+	})
+	require.NoError(t, err)
+	require.Equal(t, consumeResponse.Record.Value, []byte("chicken wings"))
+
+	time.Sleep(3 * time.Second)
+
+	followerClient := client(t, agents[1], peerTLSConfig)
+
+	consumeResponse, err = followerClient.Consume(context.Background(),
+		&api.ConsumeRequest{Offset: produceResponse.Offset})
+	require.NoError(t, err)
+	require.Equal(t, consumeResponse.Record.Value, []byte("chicken wings"))
+
+	// replicated records keep their offsets, so the record that came back
+	// through the other follower isn't appended twice
+	consumeResponse, err = followerClient.Consume(context.Background(),
+		&api.ConsumeRequest{Offset: produceResponse.Offset + 1})
+	require.Nil(t, consumeResponse)
+	require.Error(t, err)
+
+	// bootstrapping the followers' logs left the rest of their data dirs
+	for _, a := range agents[1:] {
+		_, err = os.Stat(path.Join(a.Config.DataDir, "cluster.id"))
+		require.NoError(t, err)
+	}
+}
+
+func TestMultiWriter(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, func(c *agent.Config) {
+		c.MultiWriter = true
+	})
+	defer teardown()
+
+	time.Sleep(3 * time.Second)
+
+	// every node takes a write
+	for i, agent := range agents {
+		_, err := client(t, agent, peerTLSConfig).Produce(
+			context.Background(),
+			&api.ProduceRequest{Record: &api.Record{
+				Value: []byte(fmt.Sprintf("write %d", i)),
+			}},
+		)
+		require.NoError(t, err)
+	}
+
+	time.Sleep(3 * time.Second)
+
+	// and every node ends up with each write exactly once
+	for _, agent := range agents {
+		c := client(t, agent, peerTLSConfig)
+		var values []string
+		for off := uint64(0); ; off++ {
+			res, err := c.Consume(context.Background(), &api.ConsumeRequest{Offset: off})
+			if err != nil {
+				break
+			}
+			values = append(values, string(res.Record.Value))
+		}
+		require.ElementsMatch(t, []string{"write 0", "write 1", "write 2"}, values)
+	}
+}
+
+func TestLeadershipAndDecommission(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, nil)
+	defer teardown()
+
+	time.Sleep(3 * time.Second)
+
+	ctx := context.Background()
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("chicken wings")}}
+	leaderClient := client(t, agents[0], peerTLSConfig)
+	followerClient := client(t, agents[1], peerTLSConfig)
+
+	// only the leader takes writes
+	_, err := followerClient.Produce(ctx, req)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = leaderClient.Produce(ctx, req)
+	require.NoError(t, err)
+
+	time.Sleep(time.Second)
+
+	// only the leader hands leadership over
+	_, err = followerClient.TransferLeadership(ctx, &api.TransferLeadershipRequest{
+		Node: "1",
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	transfer, err := leaderClient.TransferLeadership(ctx, &api.TransferLeadershipRequest{
+		Node: "1",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "1", transfer.Leader)
+	require.Equal(t, uint64(2), transfer.Epoch)
+	require.Eventually(t, func() bool {
+		_, err := followerClient.Produce(ctx, req)
+		return err == nil
+	}, 3*time.Second, 100*time.Millisecond)
+	_, err = leaderClient.Produce(ctx, req)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	stream, err := client(t, agents[2], peerTLSConfig).Decommission(
+		ctx,
+		&api.DecommissionRequest{},
+	)
+	require.NoError(t, err)
+	var phases []api.DecommissionPhase
+	for {
+		progress, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		phases = append(phases, progress.Phase)
+	}
+	require.Equal(t, api.DecommissionPhase_DECOMMISSION_DRAINING, phases[0])
+	require.Equal(t, api.DecommissionPhase_DECOMMISSION_DONE, phases[len(phases)-1])
+	require.NotContains(t, phases, api.DecommissionPhase_DECOMMISSION_TRANSFERRING)
+
+	// the leader waits for the in-sync replicas before it hands over
+	stream, err = followerClient.Decommission(ctx, &api.DecommissionRequest{})
+	require.NoError(t, err)
+	phases = nil
+	var leader string
+	for {
+		progress, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		phases = append(phases, progress.Phase)
+		leader = progress.Leader
+	}
+	require.Equal(t, []api.DecommissionPhase{
+		api.DecommissionPhase_DECOMMISSION_DRAINING,
+		api.DecommissionPhase_DECOMMISSION_WAITING,
+		api.DecommissionPhase_DECOMMISSION_TRANSFERRING,
+		api.DecommissionPhase_DECOMMISSION_LEAVING,
+		api.DecommissionPhase_DECOMMISSION_DONE,
+	}, dedupe(phases))
+	require.Equal(t, "0", leader)
+}
+
+// dedupe drops the phases repeated while progress is reported.
+func dedupe(phases []api.DecommissionPhase) []api.DecommissionPhase {
+	var deduped []api.DecommissionPhase
+	for i, phase := range phases {
+		if i == 0 || phase != phases[i-1] {
+			deduped = append(deduped, phase)
+		}
+	}
+	return deduped
+}
+
+func TestChainReplication(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, func(c *agent.Config) {
+		c.ChainReplication = true
+	})
+	defer teardown()
+
+	time.Sleep(3 * time.Second)
+
+	ctx := context.Background()
+	// the chain runs 0, 1, 2, so a write is acknowledged once it reached 2
+	produce, err := client(t, agents[0], peerTLSConfig).Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("chicken wings")},
+		Acks:   api.Acks_ACKS_ALL,
+	})
+	require.NoError(t, err)
+
+	req := &api.ConsumeRequest{
+		Offset:      produce.Offset,
+		Consistency: api.Consistency_CONSISTENCY_LINEARIZABLE,
+	}
+	consume, err := client(t, agents[2], peerTLSConfig).Consume(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, []byte("chicken wings"), consume.Record.Value)
+	_, err = client(t, agents[1], peerTLSConfig).Consume(ctx, req)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestPartitionAssignment(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, func(c *agent.Config) {
+		c.Partitions = 6
+		c.ReplicationFactor = 2
+	})
+	defer teardown()
+
+	time.Sleep(3 * time.Second)
+
+	ctx := context.Background()
+	leaderClient := client(t, agents[0], peerTLSConfig)
+	_, err := client(t, agents[1], peerTLSConfig).GetAssignment(
+		ctx,
+		&api.GetAssignmentRequest{},
+	)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// servers joining only filled the partitions up to their replicas
+	a, err := leaderClient.GetAssignment(ctx, &api.GetAssignmentRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 6, len(a.Partitions))
+	for _, p := range a.Partitions {
+		require.Equal(t, []string{"0", "1"}, p.Replicas)
+	}
+
+	plan, err := leaderClient.PlanReassignment(ctx, &api.PlanReassignmentRequest{})
+	require.NoError(t, err)
+	a, err = leaderClient.ExecuteReassignment(ctx, &api.ExecuteReassignmentRequest{
+		Version: plan.Version,
+	})
+	require.NoError(t, err)
+	replicas := map[string]int{}
+	for _, p := range a.Partitions {
+		for _, id := range p.Replicas {
+			replicas[id]++
+		}
+	}
+	require.Equal(t, map[string]int{"0": 4, "1": 4, "2": 4}, replicas)
+}
+
+// setupAgents starts a cluster of three agents, letting fn adjust each
+// agent's config.
+func setupAgents(t *testing.T, fn func(*agent.Config)) (
+	agents []*agent.Agent,
+	peerTLSConfig *tls.Config,
+	teardown func(),
+) {
+	t.Helper()
 	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
 		CertFile:      config.ServerCertFile,
 		KeyFile:       config.ServerKeyFile,
@@ -28,7 +277,7 @@ func Test(t *testing.T) {
 	})
 
 	require.NoError(t, err)
-	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+	peerTLSConfig, err = config.SetupTLSConfig(config.TLSConfig{
 		CertFile:      config.RootClientCertFile,
 		KeyFile:       config.RootClientKeyFile,
 		CAFile:        config.CAFile,
@@ -37,8 +286,6 @@ func Test(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	var agents []*agent.Agent
-
 	for i := 0; i < 3; i++ {
 		ports := dynaport.Get(2)
 		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
@@ -52,7 +299,7 @@ func Test(t *testing.T) {
 			startJoinAddrs = append(startJoinAddrs, agents[0].Config.BindAddr)
 		}
 
-		agent, err := agent.New(agent.Config{
+		c := agent.Config{
 			NodeName:        fmt.Sprintf("%d", i),
 			BindAddr:        bindAddr,
 			PeerTLSConfig:   peerTLSConfig,
@@ -62,46 +309,25 @@ func Test(t *testing.T) {
 			StartJoinAddrs:  startJoinAddrs,
 			ACLModelFile:    config.ACLModelFile,
 			ACLModelPolicy:  config.ACLPolicyFile,
-		})
+			Bootstrap:       i == 0,
+		}
+		if fn != nil {
+			fn(&c)
+		}
+		agent, err := agent.New(c)
 
 		require.NoError(t, err)
 		agents = append(agents, agent)
 
 	}
 
-	defer func() {
+	return agents, peerTLSConfig, func() {
 		for _, agent := range agents {
 			err := agent.Shutdown()
 			require.NoError(t, err)
-			require.NoError(t, os.Remove(agent.Config.DataDir))
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
 		}
-	}()
-
-	time.Sleep(3 * time.Second)
-
-	//Single node produce and consume
-	leaderClient := client(t, agents[0], peerTLSConfig)
-	produceResponse, err := leaderClient.Produce(context.Background(), &api.ProduceRequest{
-		Record: &api.Record{
-			Value: []byte("chicken wings"),
-		},
-	})
-
-	require.NoError(t, err)
-	consumeResponse, err := leaderClient.Consume(context.Background(), &api.ConsumeRequest{
-		Offset: 0,
-	})
-	require.NoError(t, err)
-	require.Equal(t, consumeResponse.Record.Value, []byte("chicken wings"))
-
-	time.Sleep(3 * time.Second)
-
-	followerClient := client(t, agents[1], peerTLSConfig)
-
-	consumeResponse, err = followerClient.Consume(context.Background(),
-		&api.ConsumeRequest{Offset: produceResponse.Offset})
-	require.NoError(t, err)
-	require.Equal(t, consumeResponse.Record.Value, []byte("chicken wings"))
+	}
 }
 
 func client(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api.LogClient {
@@ -0,0 +1,28 @@
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Wait returns how long to wait before retrying after the given number of
+// failures in a row. The wait starts at min and doubles with every failure
+// up to max, defaulting to 100ms and 10s, and a random wait between half
+// and all of it is picked so clients failing together don't retry in
+// lockstep.
+func Wait(failures int, min, max time.Duration) time.Duration {
+	if min == 0 {
+		min = 100 * time.Millisecond
+	}
+	if max == 0 {
+		max = 10 * time.Second
+	}
+	wait := min
+	for i := 1; i < failures && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
@@ -0,0 +1,24 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWait(t *testing.T) {
+	for _, want := range []struct {
+		failures int
+		max      time.Duration
+	}{
+		{failures: 1, max: 100 * time.Millisecond},
+		{failures: 3, max: 400 * time.Millisecond},
+		{failures: 100, max: 10 * time.Second},
+	} {
+		got := Wait(want.failures, 0, 0)
+		require.GreaterOrEqual(t, got, want.max/2, "%d failures", want.failures)
+		require.LessOrEqual(t, got, want.max, "%d failures", want.failures)
+	}
+	require.LessOrEqual(t, Wait(10, time.Millisecond, 5*time.Millisecond), 5*time.Millisecond)
+}
@@ -0,0 +1,214 @@
+package chain
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+)
+
+// recheck is how often waiters look at the chain again without being woken.
+const recheck = time.Second
+
+// Chain orders the cluster's voters into a replication chain. Writes enter
+// at the head, which is the leader, and every other voter replicates only
+// from its predecessor, so a record reaches the tail last. A write is
+// acknowledged once the tail holds it, and consistent reads are served by
+// the tail since everything it holds is held by the whole chain.
+//
+// The chain is derived from membership every time it's used: the leader
+// first and the other alive voters after it by name. A failed member drops
+// out and its successor replicates from its predecessor instead. A member
+// joining mid-chain holds up acknowledgements until it has caught up with
+// its predecessor. Non-voters aren't part of the chain and replicate from
+// the tail.
+//
+// The tail's progress flows back up the chain: each member reports the
+// tail's next offset to its predecessor along with its acknowledgements.
+type Chain struct {
+	// NodeName is the local server's name.
+	NodeName string
+	// Servers lists the cluster's alive servers.
+	Servers func() ([]*api.Server, error)
+
+	mu sync.Mutex
+	// tail is the tail's next offset as reporter, the successor at the
+	// time, last reported it
+	tail     uint64
+	reporter string
+	// changed is closed and cleared when the tail's progress or the
+	// membership changes
+	changed chan struct{}
+}
+
+// Join and Leave wake everything waiting on the chain, since the chain
+// changes with the membership.
+func (c *Chain) Join(name, addr string) error {
+	c.notify()
+	return nil
+}
+
+func (c *Chain) Leave(name string) error {
+	c.notify()
+	return nil
+}
+
+// Members returns the chain from head to tail.
+func (c *Chain) Members() []*api.Server {
+	if c.Servers == nil {
+		return nil
+	}
+	servers, err := c.Servers()
+	if err != nil {
+		return nil
+	}
+	var members []*api.Server
+	for _, server := range servers {
+		if server.Role == api.Role_ROLE_VOTER {
+			members = append(members, server)
+		}
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		if members[i].IsLeader != members[j].IsLeader {
+			return members[i].IsLeader
+		}
+		return members[i].Id < members[j].Id
+	})
+	return members
+}
+
+// Length returns how many servers the chain has.
+func (c *Chain) Length() int {
+	return len(c.Members())
+}
+
+// Tail returns the chain's tail, empty while there are no voters.
+func (c *Chain) Tail() (name, addr string) {
+	members := c.Members()
+	if len(members) == 0 {
+		return "", ""
+	}
+	tail := members[len(members)-1]
+	return tail.Id, tail.RpcAddr
+}
+
+// IsTail reports whether the local server is the chain's tail.
+func (c *Chain) IsTail() bool {
+	name, _ := c.Tail()
+	return name == c.NodeName
+}
+
+// Follows reports whether the local server replicates from the named one:
+// its predecessor in the chain, or the tail for servers outside it.
+func (c *Chain) Follows(name string) bool {
+	members := c.Members()
+	i := position(members, c.NodeName)
+	if i < 0 {
+		return len(members) > 0 && members[len(members)-1].Id == name
+	}
+	return i > 0 && members[i-1].Id == name
+}
+
+// TailOffset returns the tail's next offset the local server reports to its
+// predecessor, given its own next offset. Servers outside the chain report
+// nothing.
+func (c *Chain) TailOffset(next uint64) uint64 {
+	members := c.Members()
+	i := position(members, c.NodeName)
+	switch {
+	case i < 0:
+		return 0
+	case i == len(members)-1:
+		return next
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reporter != members[i+1].Id {
+		return 0
+	}
+	// the tail can't hold more than the servers before it
+	if c.tail > next {
+		return next
+	}
+	return c.tail
+}
+
+// Reported records the tail's next offset reported by a replica, which only
+// counts when it's the local server's successor.
+func (c *Chain) Reported(replica string, tail uint64) {
+	members := c.Members()
+	i := position(members, c.NodeName)
+	if i < 0 || i == len(members)-1 || members[i+1].Id != replica {
+		return
+	}
+	c.mu.Lock()
+	if c.reporter == replica && c.tail == tail {
+		c.mu.Unlock()
+		return
+	}
+	c.reporter, c.tail = replica, tail
+	c.mu.Unlock()
+	c.notify()
+}
+
+// WaitForTail blocks until the tail holds the records before next, or ctx
+// is done. The local server counts as holding them when it's the tail.
+func (c *Chain) WaitForTail(ctx context.Context, next uint64) error {
+	// leadership changes reorder the chain without anyone joining or
+	// leaving, so re-check periodically
+	ticker := time.NewTicker(recheck)
+	defer ticker.Stop()
+	for {
+		changed := c.Changed()
+		members := c.Members()
+		i := position(members, c.NodeName)
+		if i >= 0 && i == len(members)-1 {
+			return nil
+		}
+		if i >= 0 {
+			c.mu.Lock()
+			held := c.reporter == members[i+1].Id && c.tail >= next
+			c.mu.Unlock()
+			if held {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Changed returns a channel closed once the tail's progress or the
+// membership changes.
+func (c *Chain) Changed() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+	return c.changed
+}
+
+func (c *Chain) notify() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
+
+func position(members []*api.Server, name string) int {
+	for i, member := range members {
+		if member.Id == name {
+			return i
+		}
+	}
+	return -1
+}
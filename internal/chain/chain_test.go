@@ -0,0 +1,95 @@
+package chain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChain(t *testing.T) {
+	servers := []*api.Server{
+		{Id: "c", RpcAddr: "c:1", Role: api.Role_ROLE_VOTER},
+		{Id: "a", RpcAddr: "a:1", Role: api.Role_ROLE_VOTER},
+		{Id: "b", RpcAddr: "b:1", Role: api.Role_ROLE_VOTER, IsLeader: true},
+		{Id: "d", RpcAddr: "d:1", Role: api.Role_ROLE_NON_VOTER},
+	}
+	list := func() ([]*api.Server, error) { return servers, nil }
+	head := &Chain{NodeName: "b", Servers: list}
+	middle := &Chain{NodeName: "a", Servers: list}
+	tail := &Chain{NodeName: "c", Servers: list}
+	outside := &Chain{NodeName: "d", Servers: list}
+
+	// the leader heads the chain and the other voters follow by name
+	var names []string
+	for _, member := range head.Members() {
+		names = append(names, member.Id)
+	}
+	require.Equal(t, []string{"b", "a", "c"}, names)
+	require.Equal(t, 3, head.Length())
+	name, addr := head.Tail()
+	require.Equal(t, "c", name)
+	require.Equal(t, "c:1", addr)
+	require.True(t, tail.IsTail())
+	require.False(t, head.IsTail())
+
+	// every member follows its predecessor, non-voters follow the tail
+	require.False(t, head.Follows("c"))
+	require.True(t, middle.Follows("b"))
+	require.False(t, middle.Follows("c"))
+	require.True(t, tail.Follows("a"))
+	require.True(t, outside.Follows("c"))
+
+	// the tail reports its own progress, the others what their successor
+	// reported, capped at their own
+	require.Equal(t, uint64(5), tail.TailOffset(5))
+	require.Equal(t, uint64(0), outside.TailOffset(5))
+	require.Equal(t, uint64(0), middle.TailOffset(5))
+	middle.Reported("c", 7)
+	require.Equal(t, uint64(5), middle.TailOffset(5))
+	require.Equal(t, uint64(7), middle.TailOffset(9))
+	// only the successor's reports count
+	head.Reported("c", 3)
+	require.Equal(t, uint64(0), head.TailOffset(5))
+}
+
+func TestWaitForTail(t *testing.T) {
+	servers := []*api.Server{
+		{Id: "a", Role: api.Role_ROLE_VOTER, IsLeader: true},
+		{Id: "b", Role: api.Role_ROLE_VOTER},
+	}
+	list := func() ([]*api.Server, error) { return servers, nil }
+	head := &Chain{NodeName: "a", Servers: list}
+	tail := &Chain{NodeName: "b", Servers: list}
+	ctx := context.Background()
+
+	// the tail holds whatever it has appended
+	require.NoError(t, tail.WaitForTail(ctx, 10))
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, head.WaitForTail(timeout, 1))
+
+	waited := make(chan error, 1)
+	go func() { waited <- head.WaitForTail(ctx, 2) }()
+	head.Reported("b", 1)
+	select {
+	case <-waited:
+		t.Fatal("tail hasn't reached the offset")
+	case <-time.After(50 * time.Millisecond):
+	}
+	head.Reported("b", 2)
+	select {
+	case err := <-waited:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("wait wasn't woken by the report")
+	}
+
+	// once the tail leaves, the head is the tail
+	servers = servers[:1]
+	require.NoError(t, head.Leave("b"))
+	require.NoError(t, head.WaitForTail(ctx, 100))
+}
@@ -0,0 +1,59 @@
+package log
+
+import (
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// AppendAssignment appends a control record holding the partition
+// assignment, so replicas of the log hold it too and whichever of them
+// leads next carries on from it.
+func (l *Log) AppendAssignment(assignment *api.Assignment) error {
+	b, err := proto.Marshal(assignment)
+	if err != nil {
+		return err
+	}
+	_, err = l.Append(&api.Record{
+		Value:   b,
+		Control: api.ControlType_CONTROL_ASSIGNMENT,
+	})
+	return err
+}
+
+// Assignment returns the partition assignment the log last held, or nil
+// if it never held one.
+func (l *Log) Assignment() (*api.Assignment, error) {
+	l.mu.RLock()
+	b := l.assignment
+	l.mu.RUnlock()
+	if b == nil {
+		return nil, nil
+	}
+	assignment := &api.Assignment{}
+	if err := proto.Unmarshal(b, assignment); err != nil {
+		return nil, err
+	}
+	return assignment, nil
+}
+
+// onlyAssignments reports whether the records from offset from up to to
+// are all assignment records. It reads back from the end, so it stops at
+// the last record a writer appended.
+func (l *Log) onlyAssignments(from, to uint64) bool {
+	if from > to {
+		return false
+	}
+	for off := to; off > from; off-- {
+		record, err := l.read(off - 1)
+		if err != nil || record.Control != api.ControlType_CONTROL_ASSIGNMENT {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *Log) trackAssignment(record *api.Record) {
+	if record.Control == api.ControlType_CONTROL_ASSIGNMENT {
+		l.assignment = record.Value
+	}
+}
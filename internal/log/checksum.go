@@ -0,0 +1,159 @@
+package log
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+)
+
+// checksumRange is how many offsets each checksum covers when comparing
+// logs, before narrowing down a mismatched range record by record.
+const checksumRange = 1024
+
+// Checksums hashes the records from from up to but excluding to, or to
+// the end of the log when to is zero, in ranges of size offsets aligned to
+// multiples of size. Two logs holding the same records get the same
+// checksums for them whatever their segments look like.
+//
+// The log is only locked while a range is hashed, so appends go on between
+// ranges. Whole ranges of checksumRange offsets are kept once they're
+// hashed, since their records only change when they're truncated away.
+func (l *Log) Checksums(from, to, size uint64) ([]*api.Checksum, error) {
+	if size == 0 {
+		size = checksumRange
+	}
+	l.mu.RLock()
+	if lowest := l.segments[0].baseOffset; from < lowest {
+		from = lowest
+	}
+	if next := l.activeSegment.nextOffset; to == 0 || to > next {
+		to = next
+	}
+	l.mu.RUnlock()
+	var sums []*api.Checksum
+	for off := from; off < to; {
+		end := (off/size + 1) * size
+		if end > to {
+			end = to
+		}
+		sum, err := l.checksum(off, end, size)
+		if err != nil {
+			return nil, err
+		}
+		sums = append(sums, &api.Checksum{FirstOffset: off, NextOffset: end, Sum: sum})
+		off = end
+	}
+	return sums, nil
+}
+
+// checksum hashes the records from off up to end.
+func (l *Log) checksum(off, end, size uint64) ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	whole := size == checksumRange && off%size == 0 && end-off == size
+	if whole {
+		l.sumsMu.Lock()
+		sum, ok := l.sums[off/size]
+		l.sumsMu.Unlock()
+		if ok {
+			return sum, nil
+		}
+	}
+	h := sha256.New()
+	i := 0
+	for ; off < end; off++ {
+		for i < len(l.segments) && l.segments[i].nextOffset <= off {
+			i++
+		}
+		if i == len(l.segments) || off < l.segments[i].baseOffset {
+			// truncated since the ranges were picked
+			return nil, api.ErrOffsetOutOfRange{Offset: off}
+		}
+		s := l.segments[i]
+		_, pos, err := s.index.Read(int64(off - s.baseOffset))
+		if err != nil {
+			return nil, err
+		}
+		p, err := s.store.Read(pos)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(p)
+	}
+	sum := h.Sum(nil)
+	if whole {
+		// kept while the lock is still held, so a truncation can't have
+		// changed the range meanwhile
+		l.sumsMu.Lock()
+		l.sums[(end-1)/size] = sum
+		l.sumsMu.Unlock()
+	}
+	return sum, nil
+}
+
+// RemoteChecksums returns another log's checksums like Checksums does,
+// along with that log's next offset.
+type RemoteChecksums func(from, to, size uint64) ([]*api.Checksum, uint64, error)
+
+// Divergence compares the log with a remote one and returns the first
+// offset at which both logs hold a record but not the same one. Whole
+// ranges are compared first and only a mismatched range is compared record
+// by record. Either log being a prefix of the other, as a lagging one's is,
+// isn't divergence.
+func (l *Log) Divergence(remote RemoteChecksums) (off uint64, diverged bool, err error) {
+	local, err := l.Checksums(0, 0, checksumRange)
+	if err != nil {
+		return 0, false, err
+	}
+	theirs, _, err := remote(0, 0, checksumRange)
+	if err != nil {
+		return 0, false, err
+	}
+	ranges := make(map[uint64]*api.Checksum, len(theirs))
+	for _, c := range theirs {
+		ranges[c.FirstOffset/checksumRange] = c
+	}
+	for _, c := range local {
+		r, ok := ranges[c.FirstOffset/checksumRange]
+		if !ok {
+			// the remote log doesn't hold these records, either truncated
+			// past them or not there yet
+			continue
+		}
+		if r.FirstOffset == c.FirstOffset &&
+			r.NextOffset == c.NextOffset &&
+			bytes.Equal(r.Sum, c.Sum) {
+			continue
+		}
+		lo, hi := c.FirstOffset, c.NextOffset
+		if r.FirstOffset > lo {
+			lo = r.FirstOffset
+		}
+		if r.NextOffset < hi {
+			hi = r.NextOffset
+		}
+		if lo >= hi {
+			continue
+		}
+		mine, err := l.Checksums(lo, hi, 1)
+		if err != nil {
+			return 0, false, err
+		}
+		theirs, _, err := remote(lo, hi, 1)
+		if err != nil {
+			return 0, false, err
+		}
+		for i, m := range mine {
+			if i >= len(theirs) {
+				// the remote log ends within the range
+				break
+			}
+			if theirs[i].FirstOffset != m.FirstOffset ||
+				!bytes.Equal(theirs[i].Sum, m.Sum) {
+				return m.FirstOffset, true, nil
+			}
+		}
+	}
+	return 0, false, nil
+}
@@ -12,4 +12,8 @@ type Config struct {
 		MaxIndexBytes uint64
 		InitialOffset uint64
 	}
+	// Origin names the node appending to the log. Records appended locally
+	// are tagged with it and a per-origin sequence so replicas can tell
+	// where they came from.
+	Origin string
 }
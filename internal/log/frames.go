@@ -0,0 +1,76 @@
+package log
+
+import (
+	"io"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// ReadFrames returns the records from off on as the store holds them, each
+// an 8 byte length followed by the marshaled record, along with how many
+// records there are. A batch stops at the end of a segment or once it'd
+// exceed maxBytes, but always holds at least one record.
+func (l *Log) ReadFrames(off, maxBytes uint64) ([]byte, uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		if s.baseOffset <= off && off < s.nextOffset {
+			return s.ReadFrames(off, maxBytes)
+		}
+	}
+	return nil, 0, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// AppendFrames appends the records of a batch read with ReadFrames from
+// another log, keeping their offsets and storing the frames as they are.
+// Like AppendReplica, records the log already holds are skipped unless they
+// differ, and a gap fails with api.ErrUnexpectedOffset. It returns the
+// log's next offset.
+func (l *Log) AppendFrames(frames []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := decodeFrames(frames, func(p []byte, record *api.Record) error {
+		next := l.activeSegment.nextOffset
+		if record.Offset < next {
+			return l.checkHeld(record)
+		}
+		if record.Offset > next {
+			return api.ErrUnexpectedOffset{Expected: record.Offset, Actual: next}
+		}
+		if _, err := l.activeSegment.AppendRaw(p); err != nil {
+			return err
+		}
+		return l.wrote(record)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return l.activeSegment.nextOffset, nil
+}
+
+// decodeFrames calls fn with every frame of a batch read with ReadFrames,
+// both as stored and decoded.
+func decodeFrames(frames []byte, fn func(p []byte, record *api.Record) error) error {
+	for len(frames) > 0 {
+		if len(frames) < lenWidth {
+			return io.ErrUnexpectedEOF
+		}
+		size := enc.Uint64(frames)
+		frames = frames[lenWidth:]
+		if uint64(len(frames)) < size {
+			return io.ErrUnexpectedEOF
+		}
+		p := frames[:size]
+		frames = frames[size:]
+
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return err
+		}
+		if err := fn(p, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -31,7 +31,13 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	// if err = os.Truncate(f1.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
 	// 	return nil, err
 	// }
-	if err = idx.file.Truncate(int64(c.Segment.MaxIndexBytes)); err != nil {
+	// an index written under a larger limit keeps its entries, its segment
+	// is just full
+	max := c.Segment.MaxIndexBytes
+	if idx.size > max {
+		max = idx.size
+	}
+	if err = idx.file.Truncate(int64(max)); err != nil {
 		return nil, err
 	}
 	if idx.mmap, err = gommap.Map(idx.file.Fd(),
@@ -57,6 +63,10 @@ func (i *index) Close() error {
 	return i.file.Close()
 }
 
+func (i *index) Sync() error {
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
 func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	if i.size == 0 {
 		return 0, 0, io.EOF
@@ -85,6 +95,20 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// Truncate drops the entries from the given one on, zeroing them in the
+// mapped file too.
+func (i *index) Truncate(entries uint64) error {
+	size := entries * entWidth
+	if size >= i.size {
+		return nil
+	}
+	for j := size; j < i.size; j++ {
+		i.mmap[j] = 0
+	}
+	i.size = size
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
@@ -0,0 +1,299 @@
+package log
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	replicaKey = tag.MustNewKey("replica")
+
+	replicaLag = stats.Int64(
+		"log/replica_lag",
+		"Number of records a replica is behind the local log",
+		stats.UnitDimensionless,
+	)
+	inSyncReplicas = stats.Int64(
+		"log/in_sync_replicas",
+		"Number of followers in the in-sync replica set",
+		stats.UnitDimensionless,
+	)
+
+	// ReplicaViews report the lag of every replica and the size of the
+	// in-sync replica set. Register them to export the metrics.
+	ReplicaViews = []*view.View{
+		{
+			Name:        "log/replica_lag",
+			Measure:     replicaLag,
+			Description: "Last reported lag of each replica, in records",
+			TagKeys:     []tag.Key{replicaKey},
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        "log/in_sync_replicas",
+			Measure:     inSyncReplicas,
+			Description: "Last reported number of in-sync followers",
+			Aggregation: view.LastValue(),
+		},
+	}
+)
+
+// ReplicaTracker keeps track of how far each follower has fetched from the
+// local log, which followers are in sync, and lets producers asking for
+// ACKS_ALL wait for their records to reach the in-sync replicas.
+type ReplicaTracker struct {
+	// Log is the local log followers fetch from. Without it followers are
+	// considered caught up on every fetch.
+	Log *Log
+	// MaxLagTime is how long a follower may go without catching up before
+	// it drops out of the in-sync replica set. A follower catches up when
+	// it reaches the end of the log, or the end the log had when it last
+	// fetched, so one keeping up with continuous writes stays in sync.
+	MaxLagTime time.Duration
+	// MaxLagOffsets is how many records a follower may fall behind before
+	// it drops out of the in-sync replica set. Zero means no limit.
+	MaxLagOffsets uint64
+	// Voter reports whether a replica votes. Non-voting replicas are
+	// tracked but left out of the in-sync replica set. Without it every
+	// replica votes.
+	Voter func(id string) bool
+	// Zone returns the zone a replica runs in and LocalZone is the local
+	// log's. MinZones is how many zones the replicas holding a record must
+	// span before ACKS_ALL producers waiting on it are answered, so losing
+	// a zone can't lose the record. Replicas without a zone, the local log
+	// included, all count as the same unnamed zone.
+	Zone      func(id string) string
+	LocalZone string
+	MinZones  int
+
+	mu       sync.Mutex
+	replicas map[string]*replica
+	// changed is closed and replaced every time a replica's progress or
+	// in-sync state changes
+	changed chan struct{}
+}
+
+type replica struct {
+	// next is the next offset the replica will fetch, so it holds every
+	// record before it
+	next         uint64
+	lastFetch    time.Time
+	lastCaughtUp time.Time
+	// fetchEnd is the local log's next offset at the last fetch
+	fetchEnd uint64
+}
+
+// Fetched records that the given replica holds every record before next.
+func (t *ReplicaTracker) Fetched(id string, next uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	r, ok := t.replicas[id]
+	if !ok {
+		r = &replica{}
+		t.replicas[id] = r
+	}
+	wasInSync := ok && t.inSync(r)
+	advanced := next > r.next
+	if advanced {
+		r.next = next
+	}
+	now := time.Now()
+	lag := t.lag(r)
+	switch {
+	case lag == 0:
+		r.lastCaughtUp = now
+	case ok && r.next >= r.fetchEnd && r.lastFetch.After(r.lastCaughtUp):
+		// it holds what the log held at its last fetch, so it was caught
+		// up then
+		r.lastCaughtUp = r.lastFetch
+	}
+	r.lastFetch = now
+	r.fetchEnd = r.next + lag
+	// caught up replicas report every time they're idle, which only
+	// matters to waiters and metrics when it brings them back in sync
+	if ok && !advanced && wasInSync == t.inSync(r) {
+		return
+	}
+	close(t.changed)
+	t.changed = make(chan struct{})
+
+	_ = stats.RecordWithTags(
+		context.Background(),
+		[]tag.Mutator{tag.Upsert(replicaKey, id)},
+		replicaLag.M(int64(lag)),
+	)
+	stats.Record(context.Background(), inSyncReplicas.M(int64(t.inSyncCount())))
+}
+
+// InSync returns the voting followers in the in-sync replica set.
+func (t *ReplicaTracker) InSync() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	var ids []string
+	for id, r := range t.replicas {
+		if t.voter(id) && t.inSync(r) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Replicas reports how far every follower has fetched and whether it's in
+// sync.
+func (t *ReplicaTracker) Replicas() []*api.Replica {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	replicas := make([]*api.Replica, 0, len(t.replicas))
+	for id, r := range t.replicas {
+		replicas = append(replicas, &api.Replica{
+			Id:           id,
+			NextOffset:   r.next,
+			Lag:          t.lag(r),
+			InSync:       t.inSync(r),
+			LastFetch:    r.lastFetch.UnixNano(),
+			LastCaughtUp: r.lastCaughtUp.UnixNano(),
+			Voter:        t.voter(id),
+			Zone:         t.zone(id),
+		})
+	}
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i].Id < replicas[j].Id
+	})
+	return replicas
+}
+
+// CheckInSync fails with api.ErrNotEnoughReplicas or api.ErrNotEnoughZones
+// when the in-sync replica set couldn't hold a new record, the same way
+// WaitForReplicas would, without waiting for one.
+func (t *ReplicaTracker) CheckInSync(min int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	inSync, zones := t.count(func(*replica) bool { return true })
+	return t.checkInSync(min, inSync, zones)
+}
+
+// WaitForReplicas blocks until the record at offset is held by min replicas
+// spanning MinZones zones, counting the local log as one of them. It fails
+// with api.ErrNotEnoughReplicas or api.ErrNotEnoughZones as soon as the
+// in-sync replica set is too small.
+func (t *ReplicaTracker) WaitForReplicas(
+	ctx context.Context,
+	offset uint64,
+	min int,
+) error {
+	// followers drop out of sync without fetching, so re-check periodically
+	ticker := time.NewTicker(t.maxLagTime() / 4)
+	defer ticker.Stop()
+	for {
+		t.mu.Lock()
+		t.init()
+		inSync, inSyncZones := t.count(func(*replica) bool { return true })
+		acked, ackedZones := t.count(func(r *replica) bool { return r.next > offset })
+		changed := t.changed
+		t.mu.Unlock()
+
+		if err := t.checkInSync(min, inSync, inSyncZones); err != nil {
+			return err
+		}
+		if acked >= min && ackedZones >= t.MinZones {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return api.ErrNotEnoughReplicas{Required: min, InSync: acked}
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// count returns how many in-sync voters, the local log included, hold
+// what's asked of them and how many zones they span.
+func (t *ReplicaTracker) count(holds func(r *replica) bool) (int, int) {
+	n := 1
+	zones := map[string]bool{t.LocalZone: true}
+	for id, r := range t.replicas {
+		if t.voter(id) && t.inSync(r) && holds(r) {
+			n++
+			zones[t.zone(id)] = true
+		}
+	}
+	return n, len(zones)
+}
+
+func (t *ReplicaTracker) checkInSync(min, inSync, zones int) error {
+	if inSync < min {
+		return api.ErrNotEnoughReplicas{Required: min, InSync: inSync}
+	}
+	if zones < t.MinZones {
+		return api.ErrNotEnoughZones{Required: t.MinZones, InSync: zones}
+	}
+	return nil
+}
+
+// lag returns how many records the replica is missing from the local log.
+func (t *ReplicaTracker) lag(r *replica) uint64 {
+	if t.Log == nil {
+		return 0
+	}
+	if next := t.Log.NextOffset(); next > r.next {
+		return next - r.next
+	}
+	return 0
+}
+
+func (t *ReplicaTracker) inSync(r *replica) bool {
+	if time.Since(r.lastCaughtUp) > t.maxLagTime() {
+		return false
+	}
+	return t.MaxLagOffsets == 0 || t.lag(r) <= t.MaxLagOffsets
+}
+
+func (t *ReplicaTracker) voter(id string) bool {
+	return t.Voter == nil || t.Voter(id)
+}
+
+func (t *ReplicaTracker) zone(id string) string {
+	if t.Zone == nil {
+		return ""
+	}
+	return t.Zone(id)
+}
+
+func (t *ReplicaTracker) inSyncCount() int {
+	n := 0
+	for id, r := range t.replicas {
+		if t.voter(id) && t.inSync(r) {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *ReplicaTracker) maxLagTime() time.Duration {
+	if t.MaxLagTime == 0 {
+		return 10 * time.Second
+	}
+	return t.MaxLagTime
+}
+
+func (t *ReplicaTracker) init() {
+	if t.replicas == nil {
+		t.replicas = make(map[string]*replica)
+	}
+	if t.changed == nil {
+		t.changed = make(chan struct{})
+	}
+}
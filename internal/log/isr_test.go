@@ -0,0 +1,38 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicaTrackerContinuousWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isr-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	tracker := &ReplicaTracker{Log: log, MaxLagTime: 100 * time.Millisecond}
+
+	// every fetch returns what the log held at the one before, while the
+	// leader keeps appending, so the follower is never at the end
+	tracker.Fetched("follower", 0)
+	tracker.Fetched("stuck", 0)
+	for i := 0; i < 6; i++ {
+		next := log.NextOffset()
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+		tracker.Fetched("follower", next)
+		tracker.Fetched("stuck", 0)
+	}
+	require.Equal(t, []string{"follower"}, tracker.InSync())
+
+	// a follower that stops fetching drops out
+	time.Sleep(150 * time.Millisecond)
+	require.Empty(t, tracker.InSync())
+}
@@ -1,16 +1,20 @@
 package log
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 type Log struct {
@@ -20,6 +24,33 @@ type Log struct {
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	producers     map[uint64]*producerState
+	// txns maps open transactions to the offset of their first record and
+	// oldestTxn is the lowest of them, kept so the last stable offset
+	// needn't be searched for
+	txns      map[uint64]uint64
+	oldestTxn uint64
+	aborted   []abortedTxn
+	// origins maps each origin to the last sequence appended from it
+	origins map[string]uint64
+	// assignment is the marshaled partition assignment last appended
+	assignment []byte
+	// appended is closed and cleared once a record is appended
+	appended chan struct{}
+	// sums keeps the checksums of whole ranges of checksumRange offsets by
+	// their index. Readers holding mu's read lock share it under sumsMu,
+	// and it's changed freely under mu's write lock.
+	sums   map[uint64][]byte
+	sumsMu sync.Mutex
+	// installMu serializes installing snapshots, which share a directory
+	installMu sync.Mutex
+	// maxStoreBytes and maxIndexBytes are the segment limits the log was
+	// opened with
+	maxStoreBytes uint64
+	maxIndexBytes uint64
+	// retentionBytes is how large the stores may grow before the oldest
+	// segments are removed, 0 keeping every record
+	retentionBytes uint64
 }
 
 func (l *Log) newSegment(off uint64) error {
@@ -41,14 +72,20 @@ func NewLog(dir string, c Config) (*Log, error) {
 	}
 
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:           dir,
+		Config:        c,
+		maxStoreBytes: c.Segment.MaxStoreBytes,
+		maxIndexBytes: c.Segment.MaxIndexBytes,
 	}
 
 	return l, l.setup()
 }
 
 func (l *Log) setup() error {
+	if err := l.recoverInstall(); err != nil {
+		return err
+	}
+	l.sums = make(map[uint64][]byte)
 	files, err := ioutil.ReadDir(l.Dir)
 	if err != nil {
 		return err
@@ -56,6 +93,11 @@ func (l *Log) setup() error {
 
 	var baseOffset []uint64
 	for _, file := range files {
+		// every segment has exactly one store file, anything else in the
+		// directory isn't a segment
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
 		offStr := strings.TrimSuffix(file.Name(),
 			path.Ext(file.Name()))
 		off, _ := strconv.ParseUint(offStr, 10, 0)
@@ -69,7 +111,6 @@ func (l *Log) setup() error {
 		if err := l.newSegment(baseOffset[i]); err != nil {
 			return err
 		}
-		i++
 	}
 	if l.segments == nil {
 		if err = l.newSegment(
@@ -78,25 +119,200 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
-	return nil
+	return l.loadState()
 }
 
+// Append appends the record to the log. A record from an idempotent
+// producer that the log already holds isn't appended again, its original
+// offset is returned instead.
 func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.append(record)
+}
+
+// AppendIf appends the record only if it lands at the expected offset,
+// otherwise it fails with api.ErrUnexpectedOffset carrying the log's next
+// offset. A retry of a record the log already holds still returns its
+// original offset. Assignment records aren't the writers', so the record
+// still lands after the ones appended at or after the expected offset.
+func (l *Log) AppendIf(record *api.Record, expected uint64) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if off, dup, err := l.checkSequence(record); err != nil || dup {
+		return off, err
+	}
+	if next := l.activeSegment.nextOffset; next != expected &&
+		!l.onlyAssignments(expected, next) {
+		return 0, api.ErrUnexpectedOffset{Expected: expected, Actual: next}
+	}
+	return l.appendNew(record)
+}
+
+func (l *Log) append(record *api.Record) (uint64, error) {
+	if off, dup, err := l.checkSequence(record); err != nil || dup {
+		return off, err
+	}
+	return l.appendNew(record)
+}
+
+// appendNew appends a record whose sequence has been checked.
+func (l *Log) appendNew(record *api.Record) (uint64, error) {
+	record.AppendTime = time.Now().UnixNano()
+	l.stampOrigin(record)
+	return l.write(record)
+}
+
+// AppendReplica appends a record replicated from another log, keeping the
+// record's offset and append time. Records the log already holds are
+// skipped, but a different record at their offset fails with
+// api.ErrDiverged. A record past the log's next offset fails with
+// api.ErrUnexpectedOffset since the records before it are missing.
+func (l *Log) AppendReplica(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	next := l.activeSegment.nextOffset
+	if record.Offset < next {
+		return record.Offset, l.checkHeld(record)
+	}
+	if record.Offset > next {
+		return 0, api.ErrUnexpectedOffset{Expected: record.Offset, Actual: next}
+	}
+	return l.write(record)
+}
+
+// checkHeld fails with api.ErrDiverged unless the log holds the same record
+// at the record's offset. Records truncated away can't be compared and are
+// taken to match.
+func (l *Log) checkHeld(record *api.Record) error {
+	if record.Offset < l.segments[0].baseOffset {
+		return nil
+	}
+	held, err := l.read(record.Offset)
+	if err != nil {
+		return err
+	}
+	if !proto.Equal(held, record) {
+		return api.ErrDiverged{Offset: record.Offset}
+	}
+	return nil
+}
+
+// write appends the record to the active segment.
+func (l *Log) write(record *api.Record) (uint64, error) {
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
 	}
-	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+	return off, l.wrote(record)
+}
+
+// wrote tracks a record appended to the active segment, rolling to a new
+// segment once it's full.
+func (l *Log) wrote(record *api.Record) error {
+	l.track(record)
+	if l.appended != nil {
+		close(l.appended)
+		l.appended = nil
+	}
+	if !l.activeSegment.IsMaxed() {
+		return nil
+	}
+	// sync the full segment before rolling so Sync only has to look at
+	// the active one
+	if err := l.activeSegment.Sync(); err != nil {
+		return err
+	}
+	if err := l.newSegment(record.Offset + 1); err != nil {
+		return err
+	}
+	if err := l.saveState(); err != nil {
+		return err
+	}
+	return l.retain()
+}
+
+// SetSegmentLimits changes how large the segments created from now on may
+// grow. Zero limits go back to the ones the log was opened with.
+func (l *Log) SetSegmentLimits(maxStoreBytes, maxIndexBytes uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if maxStoreBytes == 0 {
+		maxStoreBytes = l.maxStoreBytes
+	}
+	if maxIndexBytes == 0 {
+		maxIndexBytes = l.maxIndexBytes
+	}
+	l.Config.Segment.MaxStoreBytes = maxStoreBytes
+	l.Config.Segment.MaxIndexBytes = maxIndexBytes
+}
+
+// SetRetention changes how many bytes of records the log keeps. Whenever a
+// segment fills, the oldest segments are removed while the log holds more,
+// but never the active one. Zero keeps every record.
+func (l *Log) SetRetention(bytes uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.retentionBytes = bytes
+}
+
+// retain removes the oldest segments the retention doesn't leave room for.
+func (l *Log) retain() error {
+	if l.retentionBytes == 0 {
+		return nil
+	}
+	var size uint64
+	for _, s := range l.segments {
+		size += s.store.size
+	}
+	n := 0
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if size <= l.retentionBytes {
+			break
+		}
+		size -= s.store.size
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	return l.truncateThrough(l.segments[n-1].nextOffset - 1)
+}
+
+// Wait blocks until the log holds a record at off or ctx is done.
+func (l *Log) Wait(ctx context.Context, off uint64) error {
+	l.mu.Lock()
+	if off < l.activeSegment.nextOffset {
+		l.mu.Unlock()
+		return nil
+	}
+	if l.appended == nil {
+		l.appended = make(chan struct{})
+	}
+	appended := l.appended
+	l.mu.Unlock()
+	select {
+	case <-appended:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return off, err
+}
+
+// Sync commits every appended record to disk.
+func (l *Log) Sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.Sync()
 }
 
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.read(off)
+}
+
+func (l *Log) read(off uint64) (*api.Record, error) {
 	var s *segment
 	for _, segment := range l.segments {
 		if segment.baseOffset <= off && off < segment.nextOffset {
@@ -113,6 +329,9 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 func (l *Log) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.saveState(); err != nil {
+		return err
+	}
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
@@ -141,6 +360,13 @@ func (l *Log) LowestOffset() (uint64, error) {
 	return l.segments[0].baseOffset, nil
 }
 
+// NextOffset returns the offset the next appended record will get.
+func (l *Log) NextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset
+}
+
 func (l *Log) HighestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -154,9 +380,16 @@ func (l *Log) HighestOffset() (uint64, error) {
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.truncateThrough(lowest)
+}
+
+// truncateThrough removes the segments whose records are all at or below
+// lowest.
+func (l *Log) truncateThrough(lowest uint64) error {
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
+		// an empty active segment holds nothing below lowest but is kept
+		if s != l.activeSegment && s.nextOffset <= lowest+1 {
 			if err := s.Remove(); err != nil {
 				return err
 			}
@@ -165,9 +398,84 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	for i := range l.sums {
+		if i < lowest/checksumRange {
+			delete(l.sums, i)
+		}
+	}
+	l.trimAborted()
 	return nil
 }
 
+// TruncateAfter removes every record after offset, for a replica to drop
+// records the log it follows doesn't hold.
+func (l *Log) TruncateAfter(offset uint64) error {
+	// nothing can come after the last offset, and offset+1 would wrap
+	// around to truncating everything
+	if offset == math.MaxUint64 {
+		return nil
+	}
+	_, err := l.truncateFrom(offset + 1)
+	return err
+}
+
+// truncateFrom removes the records from off on and returns the log's next
+// offset. It never removes records below the lowest offset.
+//
+// The steps are ordered so a crash partway leaves a log that holds a
+// prefix of its records: the state snapshot goes first so setup rebuilds
+// the derived state from the records, then the segments after off from the
+// last one down, and finally the segment holding off is cut.
+func (l *Log) truncateFrom(off uint64) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.truncate(off)
+}
+
+func (l *Log) truncate(off uint64) (uint64, error) {
+	if off >= l.activeSegment.nextOffset {
+		return l.activeSegment.nextOffset, nil
+	}
+	err := os.Remove(path.Join(l.Dir, stateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	for i := range l.sums {
+		if (i+1)*checksumRange > off {
+			delete(l.sums, i)
+		}
+	}
+	i := len(l.segments)
+	for i > 1 && l.segments[i-1].baseOffset >= off {
+		i--
+	}
+	for j := len(l.segments) - 1; j >= i; j-- {
+		if err = l.segments[j].Remove(); err != nil {
+			return 0, err
+		}
+	}
+	l.segments = l.segments[:i]
+	s := l.segments[i-1]
+	if off < s.baseOffset {
+		off = s.baseOffset
+	}
+	// a closed segment may be hard linked into a snapshot, so it's cut
+	// into a new file that the appends to it once it's active go to too
+	if err = s.Truncate(off, s != l.activeSegment); err != nil {
+		return 0, err
+	}
+	l.activeSegment = s
+	if s.IsMaxed() {
+		if err = l.newSegment(s.nextOffset); err != nil {
+			return 0, err
+		}
+	}
+	if err = l.loadState(); err != nil {
+		return 0, err
+	}
+	return l.activeSegment.nextOffset, nil
+}
+
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -1,8 +1,12 @@
 package log
 
 import (
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"path"
+	"path/filepath"
 	"testing"
 
 	api "github.com/abdulmajid18/log-distributed-system/api/v1"
@@ -19,6 +23,18 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"idempotent producer retries":       testIdempotentProducer,
+		"transactions and read committed":   testTransactions,
+		"append if at expected offset":      testAppendIf,
+		"append replica keeps offsets":      testAppendReplica,
+		"append origin skips seen records":  testAppendOrigin,
+		"append frames copies a log":        testAppendFrames,
+		"install snapshot copies a log":     testInstallSnapshot,
+		"snapshot outlives a truncate":      testSnapshotTruncate,
+		"divergence finds and repairs":      testDivergence,
+		"truncate after an offset":          testTruncateAfter,
+		"checksums of a cut range change":   testChecksumsAfterTruncate,
+		"assignment survives a restart":     testAssignment,
 	} {
 
 		t.Run(scenario, func(t *testing.T) {
@@ -108,3 +124,614 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func testIdempotentProducer(t *testing.T, log *Log) {
+	for i := uint64(0); i < 3; i++ {
+		off, err := log.Append(&api.Record{
+			Value:      []byte("hello world"),
+			ProducerId: 7,
+			Sequence:   i,
+		})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+
+	// a retried record gets its original offset back
+	off, err := log.Append(&api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: 7,
+		Sequence:   1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	_, err = log.Append(&api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: 7,
+		Sequence:   5,
+	})
+	apiErr := err.(api.ErrOutOfOrderSequence)
+	require.Equal(t, uint64(3), apiErr.Expected)
+
+	// the producer state survives a restart
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	off, err = n.Append(&api.Record{
+		Value:      []byte("hello world"),
+		ProducerId: 7,
+		Sequence:   2,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func testTransactions(t *testing.T, log *Log) {
+	txns := &TxnCoordinator{Log: log}
+	defer txns.Close()
+	value := func(v string) []*api.Record {
+		return []*api.Record{{Value: []byte(v)}}
+	}
+
+	_, err := log.Append(value("a")[0])
+	require.NoError(t, err)
+	committed, err := txns.Begin()
+	require.NoError(t, err)
+	offsets, err := txns.Add(committed, append(value("b"), value("c")...))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2}, offsets)
+	aborted, err := txns.Begin()
+	require.NoError(t, err)
+	_, err = txns.Add(aborted, value("d"))
+	require.NoError(t, err)
+	_, err = txns.Abort(aborted)
+	require.NoError(t, err)
+
+	// the open transaction holds back the last stable offset
+	require.Equal(t, uint64(1), log.LastStableOffset())
+	read, err := log.ReadCommitted(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), read.Value)
+	_, err = log.ReadCommitted(1)
+	require.Equal(t, uint64(1), err.(api.ErrOffsetOutOfRange).Offset)
+
+	off, err := txns.Commit(committed)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.Equal(t, uint64(6), log.LastStableOffset())
+	read, err = log.ReadCommitted(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), read.Value)
+	// the aborted record and both control records are skipped
+	_, err = log.ReadCommitted(3)
+	require.Equal(t, uint64(6), err.(api.ErrOffsetOutOfRange).Offset)
+
+	_, err = txns.Commit(committed)
+	require.Equal(t, committed, err.(api.ErrTxnNotOpen).TxnId)
+
+	// the transaction state survives a restart
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	_, err = n.ReadCommitted(3)
+	require.Equal(t, uint64(6), err.(api.ErrOffsetOutOfRange).Offset)
+
+	// a batch failing partway is rolled back along with the state its
+	// records changed
+	txns = &TxnCoordinator{Log: n}
+	defer txns.Close()
+	txn, err := txns.Begin()
+	require.NoError(t, err)
+	_, err = txns.Add(txn, []*api.Record{
+		{Value: []byte("e")},
+		{Value: []byte("f"), ProducerId: 7, Sequence: 0},
+		{Value: []byte("g"), ProducerId: 7, Sequence: 5},
+	})
+	require.Equal(t, uint64(7), err.(api.ErrOutOfOrderSequence).ProducerId)
+	require.Equal(t, uint64(6), n.NextOffset())
+	require.Equal(t, uint64(6), n.LastStableOffset())
+	off, err = n.Append(&api.Record{Value: []byte("g"), ProducerId: 7, Sequence: 5})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+
+	// the aborted transaction is forgotten once its segments are removed,
+	// restarts included
+	require.NoError(t, n.Truncate(off))
+	lowest, err := n.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, lowest, uint64(4))
+	require.Empty(t, n.aborted)
+	require.NoError(t, n.Close())
+	n, err = NewLog(n.Dir, n.Config)
+	require.NoError(t, err)
+	require.Empty(t, n.aborted)
+}
+
+func testAppendIf(t *testing.T, log *Log) {
+	record := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := log.AppendIf(record, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// another writer raced us to offset 1
+	_, err = log.Append(record)
+	require.NoError(t, err)
+	_, err = log.AppendIf(record, 1)
+	apiErr := err.(api.ErrUnexpectedOffset)
+	require.Equal(t, uint64(1), apiErr.Expected)
+	require.Equal(t, uint64(2), apiErr.Actual)
+
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	// a producer's retry gets its original offset though the log moved on
+	retried := &api.Record{Value: []byte("hello world"), ProducerId: 1}
+	off, err = log.AppendIf(retried, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	off, err = log.AppendIf(retried, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	// assignment records don't move the offset writers expect
+	require.NoError(t, log.AppendAssignment(&api.Assignment{Version: 1}))
+	off, err = log.AppendIf(record, 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+}
+
+func testAppendReplica(t *testing.T, log *Log) {
+	for i := uint64(0); i < 2; i++ {
+		off, err := log.AppendReplica(&api.Record{
+			Value:      []byte("hello world"),
+			Offset:     i,
+			AppendTime: 42,
+		})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	read, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(42), read.AppendTime)
+
+	// records the log already holds are skipped, unless they differ
+	off, err := log.AppendReplica(&api.Record{
+		Value:      []byte("hello world"),
+		AppendTime: 42,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.Equal(t, uint64(2), log.NextOffset())
+	_, err = log.AppendReplica(&api.Record{
+		Value:      []byte("another writer"),
+		Offset:     1,
+		AppendTime: 42,
+	})
+	require.Equal(t, api.ErrDiverged{Offset: 1}, err)
+
+	_, err = log.AppendReplica(&api.Record{
+		Value:  []byte("hello world"),
+		Offset: 5,
+	})
+	apiErr := err.(api.ErrUnexpectedOffset)
+	require.Equal(t, uint64(2), apiErr.Actual)
+}
+
+func testAppendOrigin(t *testing.T, log *Log) {
+	log.Config.Origin = "a"
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, "a", read.Origin)
+	require.Equal(t, uint64(1), read.OriginSequence)
+
+	replicated := &api.Record{
+		Value:          []byte("hello world"),
+		Offset:         7,
+		Origin:         "b",
+		OriginSequence: 3,
+	}
+	off, appended, err := log.AppendOrigin(replicated)
+	require.NoError(t, err)
+	require.True(t, appended)
+	require.Equal(t, uint64(1), off)
+
+	// fetched again, e.g. after a restart
+	_, appended, err = log.AppendOrigin(&api.Record{
+		Value:          []byte("hello world"),
+		Origin:         "b",
+		OriginSequence: 3,
+	})
+	require.NoError(t, err)
+	require.False(t, appended)
+	require.Equal(t, uint64(2), log.NextOffset())
+}
+
+func testAppendFrames(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	dir, err := ioutil.TempDir("", "replica-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	replica, err := NewLog(dir, log.Config)
+	require.NoError(t, err)
+
+	for off := uint64(0); off < log.NextOffset(); {
+		frames, n, err := log.ReadFrames(off, 1024)
+		require.NoError(t, err)
+		require.NotZero(t, n)
+		next, err := replica.AppendFrames(frames)
+		require.NoError(t, err)
+		off += n
+		require.Equal(t, off, next)
+	}
+	for off := uint64(0); off < log.NextOffset(); off++ {
+		want, err := log.Read(off)
+		require.NoError(t, err)
+		got, err := replica.Read(off)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, got))
+	}
+
+	// frames the replica already holds are skipped
+	frames, _, err := log.ReadFrames(0, 1024)
+	require.NoError(t, err)
+	next, err := replica.AppendFrames(frames)
+	require.NoError(t, err)
+	require.Equal(t, log.NextOffset(), next)
+
+	// but not when the replica holds a different record there
+	require.NoError(t, replica.TruncateAfter(0))
+	_, err = replica.Append(&api.Record{Value: []byte("another writer")})
+	require.NoError(t, err)
+	_, err = replica.AppendFrames(frames)
+	require.Equal(t, api.ErrDiverged{Offset: 1}, err)
+
+	_, _, err = log.ReadFrames(log.NextOffset(), 1024)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+func testInstallSnapshot(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	dir, err := ioutil.TempDir("", "replica-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	replica, err := NewLog(dir, log.Config)
+	require.NoError(t, err)
+	_, err = replica.Append(&api.Record{Value: []byte("replaced")})
+	require.NoError(t, err)
+
+	err = replica.InstallSnapshot(func(dir string) error {
+		return log.Snapshot(func(name string, r io.Reader) error {
+			return copyFile(path.Join(dir, name), r)
+		})
+	})
+	require.NoError(t, err)
+	require.Equal(t, log.NextOffset(), replica.NextOffset())
+	for off := uint64(0); off < log.NextOffset(); off++ {
+		want, err := log.Read(off)
+		require.NoError(t, err)
+		got, err := replica.Read(off)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, got))
+	}
+
+	// the snapshot's copy is gone and the log keeps appending
+	files, err := filepath.Glob(path.Join(log.Dir, "snapshot-*"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+	off, err := replica.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, log.NextOffset(), off)
+}
+
+func testSnapshotTruncate(t *testing.T, log *Log) {
+	// small records so the first segment is cut rather than removed
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("a")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+	want := log.NextOffset()
+
+	dir, err := ioutil.TempDir("", "replica-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	replica, err := NewLog(dir, log.Config)
+	require.NoError(t, err)
+	err = replica.InstallSnapshot(func(dir string) error {
+		truncated := false
+		return log.Snapshot(func(name string, r io.Reader) error {
+			if !truncated {
+				truncated = true
+				if err := log.TruncateAfter(0); err != nil {
+					return err
+				}
+				// the cut segment is active again and takes appends
+				if _, err := log.Append(&api.Record{Value: []byte("b")}); err != nil {
+					return err
+				}
+			}
+			return copyFile(path.Join(dir, name), r)
+		})
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), log.NextOffset())
+	require.Equal(t, want, replica.NextOffset())
+	for off := uint64(0); off < want; off++ {
+		record, err := replica.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("a"), record.Value)
+	}
+}
+
+func testAssignment(t *testing.T, log *Log) {
+	a, err := log.Assignment()
+	require.NoError(t, err)
+	require.Nil(t, a)
+
+	for v := uint64(1); v <= 2; v++ {
+		require.NoError(t, log.AppendAssignment(&api.Assignment{
+			Version: v,
+			Partitions: []*api.PartitionAssignment{
+				{Partition: 0, Leader: "0", Replicas: []string{"0", "1"}},
+			},
+		}))
+	}
+	// readers of committed records skip it
+	_, err = log.ReadCommitted(0)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	a, err = log.Assignment()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), a.Version)
+	require.Equal(t, []string{"0", "1"}, a.Partitions[0].Replicas)
+}
+
+func testDivergence(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	remote := func(from, to, size uint64) ([]*api.Checksum, uint64, error) {
+		sums, err := log.Checksums(from, to, size)
+		return sums, log.NextOffset(), err
+	}
+
+	dir, err := ioutil.TempDir("", "replica-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	replica, err := NewLog(dir, log.Config)
+	require.NoError(t, err)
+	frames, _, err := log.ReadFrames(0, 1024)
+	require.NoError(t, err)
+	_, err = replica.AppendFrames(frames)
+	require.NoError(t, err)
+
+	// a lagging replica hasn't diverged
+	_, diverged, err := replica.Divergence(remote)
+	require.NoError(t, err)
+	require.False(t, diverged)
+
+	// nor has a replica holding records the remote log doesn't hold yet
+	n := replica.NextOffset()
+	_, err = replica.Append(&api.Record{Value: []byte("diverged")})
+	require.NoError(t, err)
+	remote = func(from, to, size uint64) ([]*api.Checksum, uint64, error) {
+		// the remote log as it was when the replica copied it
+		if to == 0 || to > n {
+			to = n
+		}
+		sums, err := log.Checksums(from, to, size)
+		return sums, n, err
+	}
+	_, diverged, err = replica.Divergence(remote)
+	require.NoError(t, err)
+	require.False(t, diverged)
+
+	remote = func(from, to, size uint64) ([]*api.Checksum, uint64, error) {
+		sums, err := log.Checksums(from, to, size)
+		return sums, log.NextOffset(), err
+	}
+	off, diverged, err := replica.Divergence(remote)
+	require.NoError(t, err)
+	require.True(t, diverged)
+	require.Equal(t, n, off)
+
+	next, err := replica.truncateFrom(off)
+	require.NoError(t, err)
+	require.Equal(t, off, next)
+	for next < log.NextOffset() {
+		frames, _, err := log.ReadFrames(next, 1024)
+		require.NoError(t, err)
+		next, err = replica.AppendFrames(frames)
+		require.NoError(t, err)
+	}
+	_, diverged, err = replica.Divergence(remote)
+	require.NoError(t, err)
+	require.False(t, diverged)
+}
+
+func testTruncateAfter(t *testing.T, log *Log) {
+	// a segment holds all the records so it gets cut in the middle
+	dir, err := ioutil.TempDir("", "truncate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config
+	c.Segment.MaxStoreBytes = 1024
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, log.TruncateAfter(math.MaxUint64))
+	require.Equal(t, uint64(5), log.NextOffset())
+
+	require.NoError(t, log.TruncateAfter(2))
+	require.Equal(t, uint64(3), log.NextOffset())
+	_, err = log.Read(3)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	off, err := log.Append(&api.Record{Value: []byte("after truncate")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), log.NextOffset())
+	read, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("after truncate"), read.Value)
+	read, err = log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+}
+
+func TestSegmentLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-limits-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = 2 * entWidth
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	record := &api.Record{Value: []byte("hello world")}
+	_, err = log.Append(record)
+	require.NoError(t, err)
+	// the first segment keeps its limit, the ones created from now on
+	// hold five records
+	log.SetSegmentLimits(0, 5*entWidth)
+	for i := 0; i < 6; i++ {
+		_, err = log.Append(record)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, len(log.segments))
+	require.Equal(t, uint64(7), log.segments[2].baseOffset)
+
+	// reopening with the smaller limit keeps the larger segment's records
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	for off := uint64(0); off < 7; off++ {
+		_, err = log.Read(off)
+		require.NoError(t, err)
+	}
+
+	// zero limits go back to the ones the log was opened with
+	log.SetSegmentLimits(0, 0)
+	require.Equal(t, 2*entWidth, log.Config.Segment.MaxIndexBytes)
+}
+
+func TestRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = 2 * entWidth
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	log.SetRetention(1)
+
+	record := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 6; i++ {
+		_, err = log.Append(record)
+		require.NoError(t, err)
+	}
+	// only the active segment is left once every full one is over the
+	// retention
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), lowest)
+	require.Equal(t, uint64(6), log.NextOffset())
+
+	// without a retention the full segments stay
+	log.SetRetention(0)
+	for i := 0; i < 4; i++ {
+		_, err = log.Append(record)
+		require.NoError(t, err)
+	}
+	lowest, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), lowest)
+	require.Equal(t, 3, len(log.segments))
+}
+
+func TestMoveLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "move-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "cluster.id"), nil, 0644))
+
+	// only the log's files move, and only the first time
+	to := path.Join(dir, "log")
+	require.NoError(t, MoveLog(dir, to))
+	require.NoError(t, MoveLog(dir, to))
+	_, err = os.Stat(path.Join(dir, "cluster.id"))
+	require.NoError(t, err)
+	log, err = NewLog(to, Config{})
+	require.NoError(t, err)
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+
+	// installing a snapshot leaves the directory around the log alone
+	require.NoError(t, log.InstallSnapshot(func(string) error { return nil }))
+	_, err = os.Stat(path.Join(dir, "cluster.id"))
+	require.NoError(t, err)
+}
+
+func testChecksumsAfterTruncate(t *testing.T, log *Log) {
+	// a whole range of records, so its checksum is kept
+	dir, err := ioutil.TempDir("", "checksum-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < checksumRange; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	sums, err := log.Checksums(0, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sums))
+	again, err := log.Checksums(0, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, sums, again)
+
+	require.NoError(t, log.TruncateAfter(checksumRange-2))
+	_, err = log.Append(&api.Record{Value: []byte("diverged")})
+	require.NoError(t, err)
+	again, err = log.Checksums(0, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(again))
+	require.NotEqual(t, sums[0].Sum, again[0].Sum)
+}
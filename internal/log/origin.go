@@ -0,0 +1,38 @@
+package log
+
+import (
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+)
+
+// stampOrigin tags a locally appended record with this log's origin and the
+// origin's next sequence.
+func (l *Log) stampOrigin(record *api.Record) {
+	if l.Config.Origin == "" {
+		return
+	}
+	record.Origin = l.Config.Origin
+	record.OriginSequence = l.origins[l.Config.Origin] + 1
+}
+
+func (l *Log) trackOrigin(record *api.Record) {
+	if record.Origin == "" {
+		return
+	}
+	if record.OriginSequence > l.origins[record.Origin] {
+		l.origins[record.Origin] = record.OriginSequence
+	}
+}
+
+// AppendOrigin appends a record replicated from its origin, giving it the
+// log's next offset. Since an origin's records are replicated in order, a
+// record whose sequence isn't past the last one seen from its origin is
+// already in the log and is skipped, as is a record without an origin.
+func (l *Log) AppendOrigin(record *api.Record) (off uint64, appended bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if record.Origin == "" || record.OriginSequence <= l.origins[record.Origin] {
+		return 0, false, nil
+	}
+	off, err = l.write(record)
+	return off, err == nil, err
+}
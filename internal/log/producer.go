@@ -0,0 +1,65 @@
+package log
+
+import (
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+)
+
+// producerWindow is how many recent sequences the log remembers per
+// producer to answer retries with their original offsets.
+const producerWindow = 5
+
+type producerEntry struct {
+	Sequence uint64
+	Offset   uint64
+}
+
+// producerState holds the most recent records appended by a producer,
+// oldest first.
+type producerState struct {
+	Entries []producerEntry
+}
+
+// checkSequence returns the offset the record was first appended at when
+// it's a retry of a record the log already holds.
+func (l *Log) checkSequence(record *api.Record) (off uint64, dup bool, err error) {
+	if record.ProducerId == 0 {
+		return 0, false, nil
+	}
+	p, ok := l.producers[record.ProducerId]
+	if !ok || len(p.Entries) == 0 {
+		// a producer may start at any sequence
+		return 0, false, nil
+	}
+	last := p.Entries[len(p.Entries)-1]
+	if record.Sequence == last.Sequence+1 {
+		return 0, false, nil
+	}
+	for _, e := range p.Entries {
+		if e.Sequence == record.Sequence {
+			return e.Offset, true, nil
+		}
+	}
+	return 0, false, api.ErrOutOfOrderSequence{
+		ProducerId: record.ProducerId,
+		Sequence:   record.Sequence,
+		Expected:   last.Sequence + 1,
+	}
+}
+
+func (l *Log) trackSequence(record *api.Record) {
+	if record.ProducerId == 0 {
+		return
+	}
+	p, ok := l.producers[record.ProducerId]
+	if !ok {
+		p = &producerState{}
+		l.producers[record.ProducerId] = p
+	}
+	p.Entries = append(p.Entries, producerEntry{
+		Sequence: record.Sequence,
+		Offset:   record.Offset,
+	})
+	if len(p.Entries) > producerWindow {
+		p.Entries = p.Entries[len(p.Entries)-producerWindow:]
+	}
+}
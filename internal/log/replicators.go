@@ -2,21 +2,165 @@ package log
 
 import (
 	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"github.com/abdulmajid18/log-distributed-system/internal/backoff"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 )
 
 type Replicator struct {
 	DialOptions []grpc.DialOption
-	LocalServer api.LogClient
+	// Log is the local log records are replicated into
+	Log *Log
+	// NodeName identifies this replica to the servers it fetches from
+	NodeName string
+	// DataDir is where the replicator persists how far it has fetched from
+	// each server, so it can resume after a restart
+	DataDir string
+	// MultiWriter replicates between servers that all accept writes. Only
+	// the records a server originated are fetched from it and they're given
+	// local offsets, instead of every record keeping its offset.
+	MultiWriter bool
+	// MinBackoff and MaxBackoff bound how long the replicator waits before
+	// reconnecting to a server it failed to replicate from, they default
+	// to 100ms and 10s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// BatchBytes bounds the batches fetched from a server, the server picks
+	// the size when it's zero.
+	BatchBytes uint64
+	// Verify compares the local log with a server's every time the
+	// replicator connects to it, reporting the first offset at which they
+	// diverged. Repair verifies too and then truncates the local log from
+	// that offset so it's fetched again from the server. Only the servers
+	// replicated from are compared with, so a leader is never repaired.
+	Verify bool
+	Repair bool
+	// Leader, when set, returns the name of the leader the replica knows,
+	// empty while there's none. Only the leader is replicated from, so a
+	// leader replicates from no one.
+	Leader func() string
+	// Lease is how long the leader may serve linearizable reads on the
+	// strength of an acknowledgement, it defaults to one second. A replica
+	// following a new leader doesn't acknowledge it until the lease it
+	// granted the previous one ran out, so two leaders never both hold one.
+	Lease time.Duration
+	// Chain, when set, replicates along a chain instead of from every
+	// server: only the servers it follows are replicated from, and the
+	// chain's tail progress is reported with every acknowledgement.
+	Chain Chain
+
 	logger      *zap.Logger
 	mu          sync.Mutex
-	servers     map[string]chan struct{}
-	closed      bool
-	close       chan struct{}
+	bootstrapMu sync.Mutex
+	servers     map[string]*peer
+	progress    map[string]uint64
+	// leaseHolder is the server last acknowledged, at leaseGranted
+	leaseHolder  string
+	leaseGranted time.Time
+	closed       bool
+	close        chan struct{}
+}
+
+const progressFile = "replication.progress"
+
+// Chain decides which servers a replica in a replication chain replicates
+// from and what it reports of the tail's progress.
+type Chain interface {
+	// Follows reports whether to replicate from the named server.
+	Follows(name string) bool
+	// TailOffset returns the tail's next offset to report, given the
+	// local log's.
+	TailOffset(next uint64) uint64
+	// Changed returns a channel closed once the chain or the tail's
+	// progress changes.
+	Changed() <-chan struct{}
+}
+
+// errUnfollowed ends the stream from a server the chain no longer follows.
+var errUnfollowed = errors.New("the server is no longer followed")
+
+// followRecheck is how often an idle peer checks whether it's followed
+// again without the chain changing.
+const followRecheck = time.Second
+
+// ackInterval is how often a replica acknowledges while no batches come
+// through, so the server keeps counting it as caught up.
+const ackInterval = 100 * time.Millisecond
+
+// PeerState is where replication from a server stands.
+type PeerState int
+
+const (
+	// PeerConnecting is dialing the server and opening the stream.
+	PeerConnecting PeerState = iota
+	// PeerBootstrapping is installing a snapshot of the server's log.
+	PeerBootstrapping
+	// PeerStreaming is receiving records from the server.
+	PeerStreaming
+	// PeerBackoff is waiting to reconnect after a failure.
+	PeerBackoff
+	// PeerStopped no longer replicates, the server left or the replicator
+	// closed.
+	PeerStopped
+	// PeerIdle isn't replicated from since the chain doesn't follow the
+	// server, until it does.
+	PeerIdle
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerConnecting:
+		return "connecting"
+	case PeerBootstrapping:
+		return "bootstrapping"
+	case PeerStreaming:
+		return "streaming"
+	case PeerBackoff:
+		return "backoff"
+	case PeerStopped:
+		return "stopped"
+	case PeerIdle:
+		return "idle"
+	}
+	return "unknown"
+}
+
+// PeerStatus reports how replication from a server is going.
+type PeerStatus struct {
+	Name  string
+	Addr  string
+	State PeerState
+	// Since is when the peer entered its state.
+	Since time.Time
+	// Offset is the next offset to fetch from the server.
+	Offset uint64
+	// Failures counts the attempts that failed since records last came
+	// through.
+	Failures  int
+	LastError string
+	// Diverged is set when the local log holds records from DivergedAt on
+	// that the server doesn't, as found the last time they were compared.
+	Diverged   bool
+	DivergedAt uint64
+	// Repairs counts how often the local log was truncated to match the
+	// server's.
+	Repairs int
+}
+
+type peer struct {
+	leave  chan struct{}
+	status PeerStatus
 }
 
 //Join adds the server of the given address to list of servers to replicate from
@@ -30,84 +174,525 @@ func (r *Replicator) Join(name, addr string) error {
 		return nil
 	}
 
-	if _, ok := r.servers[name]; ok {
+	if p, ok := r.servers[name]; ok && p.status.State != PeerStopped {
 		//already replicating so return nil
 		return nil
 	}
+	p := &peer{
+		leave: make(chan struct{}),
+		status: PeerStatus{
+			Name:  name,
+			Addr:  addr,
+			State: PeerConnecting,
+			Since: time.Now(),
+		},
+	}
+	r.servers[name] = p
 
-	r.servers[name] = make(chan struct{})
-
-	go r.replicate(addr, r.servers[name])
+	go r.replicate(p)
 
 	return nil
 
 }
 
-//replicates logs received from serf member to the local server
-func (r *Replicator) replicate(addr string, leave chan struct{}) {
-	cc, err := grpc.Dial(addr, r.DialOptions...)
+//replicates logs received from serf member to the local server until the
+//member leaves, reconnecting with backoff whenever the stream fails
+func (r *Replicator) replicate(p *peer) {
+	defer r.setState(p, PeerStopped, nil)
+	for {
+		if !r.follows(p) {
+			r.setState(p, PeerIdle, nil)
+			select {
+			case <-r.close:
+				return
+			case <-p.leave:
+				return
+			case <-r.changed():
+			case <-time.After(followRecheck):
+			}
+			continue
+		}
+		r.setState(p, PeerConnecting, nil)
+		err := r.stream(p)
+		if err == nil {
+			return
+		}
+		if err == errUnfollowed {
+			continue
+		}
+		r.logError(err, "failed to replicate", p.status.Addr)
+		wait := r.setState(p, PeerBackoff, err)
+		select {
+		case <-r.close:
+			return
+		case <-p.leave:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// stream replicates from the server over a single stream, keeping the
+// offsets the records have on the server unless there are multiple writers.
+// It returns nil once replication should stop and the error that broke the
+// stream otherwise.
+func (r *Replicator) stream(p *peer) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
+	cc, err := grpc.DialContext(ctx, p.status.Addr, r.DialOptions...)
 	if err != nil {
-		r.logError(err, "failed to dial", addr)
+		return err
 	}
-
 	defer cc.Close()
-	client := api.NewLogClient(cc)
 
-	ctx := context.Background()
+	return r.replicateFrames(ctx, p, api.NewLogClient(cc))
+}
 
-	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+// replicateFrames appends the batches of store frames the server streams,
+// acknowledging each batch once it's appended. The server keeps sending
+// while batches are appended, so the two overlap. With multiple writers the
+// records are appended one by one and acknowledged with the server's
+// offsets.
+func (r *Replicator) replicateFrames(ctx context.Context, p *peer, client api.LogClient) error {
+	if !r.MultiWriter {
+		if err := r.bootstrap(ctx, p, client); err != nil {
+			return err
+		}
+		if err := r.verify(ctx, p, client); err != nil {
+			return err
+		}
+	}
+	stream, err := client.Replicate(ctx)
 	if err != nil {
-		r.logError(err, "failed to consume", addr)
-		return
+		return err
+	}
+	// acknowledgements and chain progress reports share the stream
+	var sendMu sync.Mutex
+	send := func(req *api.ReplicateRequest) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		if r.Chain != nil {
+			req.ChainTail = r.Chain.TailOffset(r.Log.NextOffset())
+		}
+		return stream.Send(req)
 	}
+	if err = send(&api.ReplicateRequest{
+		Offset:    r.offset(p.status.Name),
+		ReplicaId: r.NodeName,
+		MaxBytes:  r.BatchBytes,
+	}); err != nil {
+		return err
+	}
+	go r.heartbeat(ctx, p, send)
+	r.setState(p, PeerStreaming, nil)
+	return r.pump(ctx, p, func() (func() error, error) {
+		batch, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			next, err := r.appendBatch(p.status.Name, batch)
+			if err != nil {
+				return err
+			}
+			r.fetched(p, next)
+			return r.ack(p, send)
+		}, nil
+	})
+}
+
+// heartbeat acknowledges again every ackInterval, and whenever the chain
+// changes, so the server keeps counting the replica as caught up and the
+// tail's progress reaches the head even while no batches come through. A
+// failed send breaks the stream, which the pump finds.
+func (r *Replicator) heartbeat(
+	ctx context.Context,
+	p *peer,
+	send func(*api.ReplicateRequest) error,
+) {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	for {
+		changed := r.changed()
+		if err := r.ack(p, send); err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
 
-	records := make(chan *api.Record)
+// ack acknowledges everything the local log holds to the server, unless
+// the replica may not grant it a lease.
+func (r *Replicator) ack(p *peer, send func(*api.ReplicateRequest) error) error {
+	if !r.grantLease(p) {
+		return nil
+	}
+	return send(&api.ReplicateRequest{Offset: r.offset(p.status.Name)})
+}
+
+// grantLease reports whether the server may be acknowledged. Only the
+// server followed is, and with a leader only once the lease granted to any
+// other server ran out.
+func (r *Replicator) grantLease(p *peer) bool {
+	if !r.follows(p) {
+		return false
+	}
+	if r.Leader == nil {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name := p.status.Name
+	if r.leaseHolder != name && time.Since(r.leaseGranted) < r.lease() {
+		return false
+	}
+	r.leaseHolder, r.leaseGranted = name, time.Now()
+	return true
+}
+
+func (r *Replicator) lease() time.Duration {
+	if r.Lease == 0 {
+		return time.Second
+	}
+	return r.Lease
+}
+
+// follows reports whether the server is replicated from: the one the chain
+// follows, the leader, or every server without either.
+func (r *Replicator) follows(p *peer) bool {
+	switch {
+	case r.Chain != nil:
+		return r.Chain.Follows(p.status.Name)
+	case r.Leader != nil:
+		return r.Leader() == p.status.Name
+	}
+	return true
+}
+
+// changed returns a channel closed once the chain changes, a nil one that
+// never is without a chain.
+func (r *Replicator) changed() <-chan struct{} {
+	if r.Chain == nil {
+		return nil
+	}
+	return r.Chain.Changed()
+}
+
+// bootstrap installs a snapshot of the server's log when nothing has been
+// replicated yet, so a new replica doesn't replay the server's whole history
+// record by record.
+func (r *Replicator) bootstrap(ctx context.Context, p *peer, client api.LogClient) error {
+	// only the first server replicated from bootstraps the log, the others
+	// find it no longer empty
+	r.bootstrapMu.Lock()
+	defer r.bootstrapMu.Unlock()
+	lowest, err := r.Log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	fetched := r.progress[p.status.Name] > 0
+	r.mu.Unlock()
+	if fetched || r.Log.NextOffset() != lowest {
+		return nil
+	}
+	r.setState(p, PeerBootstrapping, nil)
+	return r.Log.InstallSnapshot(func(dir string) error {
+		stream, err := client.GetSnapshot(ctx, &api.GetSnapshotRequest{})
+		if err != nil {
+			return err
+		}
+		var f *os.File
+		defer func() {
+			if f != nil {
+				f.Close()
+			}
+		}()
+		for {
+			chunk, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			// the server only names files, never where to put them
+			name := path.Join(dir, filepath.Base(chunk.Name))
+			if f == nil || f.Name() != name {
+				if f != nil {
+					if err = f.Close(); err != nil {
+						return err
+					}
+				}
+				if f, err = os.Create(name); err != nil {
+					return err
+				}
+			}
+			if _, err = f.Write(chunk.Data); err != nil {
+				return err
+			}
+		}
+		if f == nil {
+			return nil
+		}
+		err = f.Close()
+		f = nil
+		return err
+	})
+}
+
+// verify compares the local log with the server's and, when repairing,
+// truncates the records the server doesn't hold the same.
+func (r *Replicator) verify(ctx context.Context, p *peer, client api.LogClient) error {
+	if !r.Verify && !r.Repair {
+		return nil
+	}
+	off, diverged, err := r.Log.Divergence(func(from, to, size uint64) ([]*api.Checksum, uint64, error) {
+		res, err := client.GetChecksums(ctx, &api.GetChecksumsRequest{
+			FromOffset: from,
+			ToOffset:   to,
+			RangeSize:  size,
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		return res.Checksums, res.NextOffset, nil
+	})
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	p.status.Diverged, p.status.DivergedAt = diverged, off
+	r.mu.Unlock()
+	if !diverged {
+		return nil
+	}
+	r.logger.Warn(
+		"log diverged from server",
+		zap.String("addr", p.status.Addr),
+		zap.Uint64("offset", off),
+	)
+	if !r.Repair {
+		return nil
+	}
+	// the server may have handed leadership over meanwhile, maybe to this
+	// replica
+	if !r.follows(p) {
+		return errUnfollowed
+	}
+	next, err := r.Log.truncateFrom(off)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// nothing past the truncated log was fetched from any server anymore
+	for name, fetched := range r.progress {
+		if fetched > next {
+			r.progress[name] = next
+		}
+	}
+	p.status.Diverged = false
+	p.status.Repairs++
+	return nil
+}
+
+// pump receives from a stream in the background and applies what it
+// received until the server leaves, the replicator closes or the stream
+// fails.
+func (r *Replicator) pump(
+	ctx context.Context,
+	p *peer,
+	recv func() (apply func() error, err error),
+) error {
+	applies := make(chan func() error)
+	errs := make(chan error, 1)
 
-	// Receive all records and pass to records channel
 	go func() {
 		for {
-			recv, err := stream.Recv()
+			apply, err := recv()
 			if err != nil {
-				r.logError(err, "Failed to receive", addr)
+				errs <- err
+				return
+			}
+			select {
+			case applies <- apply:
+			case <-ctx.Done():
 				return
 			}
-			// Pass records received from the client to this chan
-			records <- recv.Record
 		}
 	}()
 
-	// Produce records from the records chan until the server leaves or fails
+	// progress is saved periodically rather than per record
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer r.saveProgress()
+
+	changed := r.changed()
+
 	for {
 		select {
 		case <-r.close:
-			return
-		case <-leave:
-			return
-		case records := <-records:
-			_, err = r.LocalServer.Produce(ctx, &api.ProduceRequest{
-				Record: records,
-			})
-
-			if err != nil {
-				r.logError(err, "Failed to produce", addr)
+			return nil
+		case <-p.leave:
+			return nil
+		case err := <-errs:
+			return err
+		case <-changed:
+			changed = r.changed()
+			if !r.follows(p) {
+				return errUnfollowed
+			}
+		case <-ticker.C:
+			r.saveProgress()
+			if !r.follows(p) {
+				return errUnfollowed
+			}
+		case apply := <-applies:
+			// reconnecting resumes at the right offset, so whatever
+			// can't be appended ends the stream
+			if err := apply(); err != nil {
+				return err
 			}
 		}
 	}
 }
 
+// setState moves the peer to the given state and, when it backs off,
+// returns how long to wait before reconnecting. A stopped peer stays
+// stopped.
+func (r *Replicator) setState(p *peer, state PeerState, err error) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p.status.State == PeerStopped {
+		return 0
+	}
+	if p.status.State != state {
+		p.status.State = state
+		p.status.Since = time.Now()
+	}
+	if err == nil {
+		return 0
+	}
+	p.status.Failures++
+	p.status.LastError = err.Error()
+	return r.backoff(p.status.Failures)
+}
+
+// backoff is how long to wait before reconnecting, randomized so replicas
+// don't reconnect in lockstep.
+func (r *Replicator) backoff(failures int) time.Duration {
+	return backoff.Wait(failures, r.MinBackoff, r.MaxBackoff)
+}
+
+// Peers reports the state of replication from every server that joined.
+func (r *Replicator) Peers() []PeerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+	peers := make([]PeerStatus, 0, len(r.servers))
+	for name, p := range r.servers {
+		status := p.status
+		status.Offset = r.progress[name]
+		peers = append(peers, status)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+	return peers
+}
+
+// appendBatch adds a batch fetched from the named server to the local log
+// and returns the next offset to fetch from the server.
+func (r *Replicator) appendBatch(name string, batch *api.ReplicateResponse) (uint64, error) {
+	if !r.MultiWriter {
+		return r.Log.AppendFrames(batch.Frames)
+	}
+	err := decodeFrames(batch.Frames, func(_ []byte, record *api.Record) error {
+		// the server's log also holds the records it replicated from
+		// others, those are fetched from their origin instead so they
+		// aren't passed around in a loop
+		if record.Origin != name {
+			return nil
+		}
+		_, _, err := r.Log.AppendOrigin(record)
+		return err
+	})
+	return batch.Offset + batch.Count, err
+}
+
+// offset returns where to resume fetching from the named server. With a
+// single writer that's the local log's next offset, whatever the saved
+// progress says, since records past it can't be appended without the ones
+// before them. With multiple writers local offsets don't match the
+// server's so only the saved progress counts.
+func (r *Replicator) offset(name string) uint64 {
+	if !r.MultiWriter {
+		return r.Log.NextOffset()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.progress[name]
+}
+
+func (r *Replicator) fetched(p *peer, next uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress[p.status.Name] = next
+	p.status.Failures = 0
+	p.status.LastError = ""
+}
+
+func (r *Replicator) saveProgress() {
+	if r.DataDir == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := writeGob(path.Join(r.DataDir, progressFile), r.progress); err != nil {
+		r.logger.Error("failed to save progress", zap.Error(err))
+	}
+}
+
+func (r *Replicator) loadProgress() {
+	r.progress = make(map[string]uint64)
+	if r.DataDir == "" {
+		return
+	}
+	f, err := os.Open(path.Join(r.DataDir, progressFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.logger.Error("failed to load progress", zap.Error(err))
+		}
+		return
+	}
+	defer f.Close()
+	if err = gob.NewDecoder(f).Decode(&r.progress); err != nil {
+		r.logger.Error("failed to load progress", zap.Error(err))
+	}
+}
+
 // Leave Handles server leaving by removing it from the
 // list of servers to replicate from
 func (r *Replicator) Leave(name string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.init()
-	if _, ok := r.servers[name]; !ok {
+	p, ok := r.servers[name]
+	if !ok || p.status.State == PeerStopped {
 		return nil
 	}
 
-	close(r.servers[name])
-	delete(r.servers, name)
+	// the peer is kept so its stopped state can be reported
+	close(p.leave)
+	p.status.State = PeerStopped
+	p.status.Since = time.Now()
 
 	return nil
 }
@@ -124,7 +709,10 @@ func (r *Replicator) init() {
 		r.logger = zap.L().Named("replicator")
 	}
 	if r.servers == nil {
-		r.servers = make(map[string]chan struct{})
+		r.servers = make(map[string]*peer)
+	}
+	if r.progress == nil {
+		r.loadProgress()
 	}
 
 	if r.close == nil {
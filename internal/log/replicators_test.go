@@ -0,0 +1,115 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestReplicatorBackoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	r := &Replicator{
+		DialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+		Log:        l,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	}
+	// nothing listens on the peer's address
+	addr := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+	require.NoError(t, r.Join("peer", addr))
+
+	require.Eventually(t, func() bool {
+		peers := r.Peers()
+		return len(peers) == 1 &&
+			peers[0].State == PeerBackoff &&
+			peers[0].Failures > 1 &&
+			peers[0].LastError != ""
+	}, 3*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, r.Leave("peer"))
+	peers := r.Peers()
+	require.Equal(t, PeerStopped, peers[0].State)
+	require.Equal(t, "stopped", peers[0].State.String())
+	require.NoError(t, r.Close())
+}
+
+func TestReplicatorBackoffGrows(t *testing.T) {
+	r := &Replicator{
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: time.Second,
+	}
+	for _, tc := range []struct {
+		failures int
+		max      time.Duration
+	}{
+		{failures: 1, max: 100 * time.Millisecond},
+		{failures: 2, max: 200 * time.Millisecond},
+		{failures: 3, max: 400 * time.Millisecond},
+		{failures: 10, max: time.Second},
+	} {
+		wait := r.backoff(tc.failures)
+		require.True(t, wait >= tc.max/2 && wait <= tc.max, "failures %d: %s", tc.failures, wait)
+	}
+}
+
+func TestReplicatorFollowsLeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	r := &Replicator{
+		DialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+		Log:        l,
+		Leader:     func() string { return "leader" },
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	}
+	ports := dynaport.Get(2)
+	require.NoError(t, r.Join("leader", fmt.Sprintf("127.0.0.1:%d", ports[0])))
+	require.NoError(t, r.Join("follower", fmt.Sprintf("127.0.0.1:%d", ports[1])))
+
+	// only the leader is dialed
+	require.Eventually(t, func() bool {
+		peers := r.Peers()
+		return peers[0].State == PeerIdle && peers[1].State == PeerBackoff
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, "follower", r.Peers()[0].Name)
+	require.NoError(t, r.Close())
+}
+
+func TestReplicatorLease(t *testing.T) {
+	leader := "a"
+	r := &Replicator{
+		Leader: func() string { return leader },
+		Lease:  50 * time.Millisecond,
+	}
+	a := &peer{status: PeerStatus{Name: "a"}}
+	b := &peer{status: PeerStatus{Name: "b"}}
+	require.True(t, r.grantLease(a))
+	require.False(t, r.grantLease(b))
+
+	// the new leader is only acknowledged once a's lease ran out
+	leader = "b"
+	require.False(t, r.grantLease(a))
+	require.False(t, r.grantLease(b))
+	time.Sleep(r.Lease)
+	require.True(t, r.grantLease(b))
+}
@@ -50,12 +50,18 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 }
 
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
-	cur := s.nextOffset
-	record.Offset = cur
+	record.Offset = s.nextOffset
 	p, err := proto.Marshal(record)
 	if err != nil {
 		return 0, err
 	}
+	return s.AppendRaw(p)
+}
+
+// AppendRaw appends an already marshaled record, which must carry the
+// segment's next offset.
+func (s *segment) AppendRaw(p []byte) (offset uint64, err error) {
+	cur := s.nextOffset
 	_, pos, err := s.store.Append(p)
 	if err != nil {
 		return 0, err
@@ -72,6 +78,34 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 
 }
 
+// ReadFrames returns the store frames of the records from off on, up to
+// maxBytes of them but at least one, and how many records they hold.
+func (s *segment) ReadFrames(off, maxBytes uint64) ([]byte, uint64, error) {
+	_, start, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return nil, 0, err
+	}
+	end, n := start, uint64(0)
+	for ; off+n < s.nextOffset; n++ {
+		// a record's frame ends where the next one starts
+		stop := s.store.size
+		if next := off + n + 1; next < s.nextOffset {
+			if _, stop, err = s.index.Read(int64(next - s.baseOffset)); err != nil {
+				return nil, 0, err
+			}
+		}
+		if n > 0 && stop-start > maxBytes {
+			break
+		}
+		end = stop
+	}
+	b := make([]byte, end-start)
+	if _, err := s.store.ReadAt(b, int64(start)); err != nil {
+		return nil, 0, err
+	}
+	return b, n, nil
+}
+
 func (s *segment) Read(off uint64) (*api.Record, error) {
 	_, pos, err := s.index.Read(int64(off - s.baseOffset))
 	if err != nil {
@@ -86,11 +120,49 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	return record, err
 }
 
+// Truncate removes the records from next on. The index is cut first so it
+// never points past the end of the store. With rewrite set the store is
+// cut into a new file even if no record is removed, leaving hard links to
+// the old one as they were.
+func (s *segment) Truncate(next uint64, rewrite bool) error {
+	if next >= s.nextOffset {
+		if !rewrite {
+			return nil
+		}
+		return s.store.Rewrite(s.store.size)
+	}
+	// the first removed record starts where the store gets cut
+	_, pos, err := s.index.Read(int64(next - s.baseOffset))
+	if err != nil {
+		return err
+	}
+	if err = s.index.Truncate(next - s.baseOffset); err != nil {
+		return err
+	}
+	if rewrite {
+		err = s.store.Rewrite(uint64(pos))
+	} else {
+		err = s.store.Truncate(uint64(pos))
+	}
+	if err != nil {
+		return err
+	}
+	s.nextOffset = next
+	return nil
+}
+
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
 		s.index.size >= s.config.Segment.MaxIndexBytes
 }
 
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
 func (s *segment) Close() error {
 	if err := s.index.Close(); err != nil {
 		return err
@@ -0,0 +1,238 @@
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const (
+	// installSuffix names the directory a snapshot is received into, next
+	// to the log's directory.
+	installSuffix = ".install"
+	// oldSuffix names the log's previous directory while a snapshot
+	// replaces it.
+	oldSuffix = ".old"
+)
+
+// Snapshot takes a point-in-time copy of the log and passes each of its
+// files to fn. Closed segments' stores are hard linked, which is safe since
+// truncating the log rewrites a closed segment into a new file, and only
+// the active segment's store is copied up to what it holds now. The copy
+// is removed once fn has seen every file.
+func (l *Log) Snapshot(fn func(name string, r io.Reader) error) error {
+	dir, err := l.snapshot()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		f, err := os.Open(path.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		err = fn(file.Name(), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot copies the log into a new directory inside the log's directory,
+// which setup ignores since it holds no store files itself.
+func (l *Log) snapshot() (dir string, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if dir, err = ioutil.TempDir(l.Dir, "snapshot-"); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	for _, s := range l.segments {
+		store := path.Join(dir, path.Base(s.store.Name()))
+		if s == l.activeSegment {
+			err = copyFile(store, io.NewSectionReader(s.store, 0, int64(s.store.size)))
+		} else if err = s.store.Flush(); err == nil {
+			err = os.Link(s.store.Name(), store)
+		}
+		if err != nil {
+			return "", err
+		}
+		// the index file is kept at its maximum size while it's open, so
+		// only the entries it holds are copied
+		if err = ioutil.WriteFile(
+			path.Join(dir, path.Base(s.index.Name())),
+			s.index.mmap[:s.index.size],
+			0644,
+		); err != nil {
+			return "", err
+		}
+	}
+	return dir, writeGob(path.Join(dir, stateFile), logState{
+		Offset:     l.activeSegment.nextOffset,
+		Producers:  l.producers,
+		Txns:       l.txns,
+		Aborted:    l.aborted,
+		Origins:    l.origins,
+		Assignment: l.assignment,
+	})
+}
+
+func copyFile(name string, r io.Reader) error {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// InstallSnapshot replaces the log's contents with a snapshot taken by
+// another log's Snapshot. fill writes the snapshot's files into the
+// directory it's given, and only once it succeeds is that directory
+// swapped in for the log's. A crash partway through the swap is finished
+// by the next setup. The whole directory is replaced, so it mustn't hold
+// anything but the log.
+func (l *Log) InstallSnapshot(fill func(dir string) error) error {
+	l.installMu.Lock()
+	defer l.installMu.Unlock()
+	dir := path.Clean(l.Dir) + installSuffix
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := fill(dir); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.segments {
+		if err := s.Close(); err != nil {
+			return err
+		}
+	}
+	l.segments, l.activeSegment = nil, nil
+	if err := l.swap(dir); err != nil {
+		// reopen whichever log the failed swap left in place rather than
+		// leaving the log without segments
+		if setupErr := l.setup(); setupErr != nil {
+			return setupErr
+		}
+		return err
+	}
+	if err := l.setup(); err != nil {
+		return err
+	}
+	if l.appended != nil {
+		close(l.appended)
+		l.appended = nil
+	}
+	return nil
+}
+
+// swap moves the log's directory aside and the installed one in its place.
+func (l *Log) swap(dir string) error {
+	if err := os.Rename(l.Dir, path.Clean(l.Dir)+oldSuffix); err != nil {
+		return err
+	}
+	if err := os.Rename(dir, l.Dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(path.Clean(l.Dir) + oldSuffix)
+}
+
+// MoveLog moves the files of a log kept in dir, alongside other files, into
+// a directory of its own at to, which is created. Nothing is moved once to
+// exists. The files are gathered next to to first, so a crash partway
+// leaves them to be moved again rather than split between the two.
+func MoveLog(dir, to string) error {
+	if _, err := os.Stat(to); !os.IsNotExist(err) {
+		return err
+	}
+	tmp := path.Clean(to) + ".move"
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if ext := path.Ext(name); ext != ".store" && ext != ".index" && name != stateFile {
+			continue
+		}
+		if err = os.Rename(path.Join(dir, name), path.Join(tmp, name)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, to)
+}
+
+// syncDir commits the files in the directory to disk.
+func syncDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		f, err := os.Open(path.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverInstall finishes installing a snapshot that was interrupted after
+// the log's directory was moved aside but before the snapshot took its
+// place, and cleans up after one that was interrupted later. It also drops
+// the copies of snapshots that were being sent when the process stopped.
+func (l *Log) recoverInstall() error {
+	if _, err := os.Stat(l.Dir); os.IsNotExist(err) {
+		if _, err := os.Stat(path.Clean(l.Dir) + installSuffix); err == nil {
+			if err := os.Rename(path.Clean(l.Dir)+installSuffix, l.Dir); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.RemoveAll(path.Clean(l.Dir) + oldSuffix); err != nil {
+		return err
+	}
+	snapshots, err := filepath.Glob(path.Join(l.Dir, "snapshot-*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range snapshots {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package log
+
+import (
+	"encoding/gob"
+	"os"
+	"path"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+)
+
+const stateFile = "state.snapshot"
+
+// logState is what the log derives from its records besides the records
+// themselves, built from every record before Offset.
+type logState struct {
+	Offset    uint64
+	Producers map[uint64]*producerState
+	Txns      map[uint64]uint64
+	Aborted   []abortedTxn
+	Origins   map[string]uint64
+	// Assignment is the last partition assignment appended
+	Assignment []byte
+}
+
+// track updates the derived state with an appended record.
+func (l *Log) track(record *api.Record) {
+	l.trackSequence(record)
+	l.trackTxn(record)
+	l.trackOrigin(record)
+	l.trackAssignment(record)
+}
+
+// saveState snapshots the derived state so setup only has to replay the
+// records appended since.
+func (l *Log) saveState() error {
+	return writeGob(path.Join(l.Dir, stateFile), logState{
+		Offset:     l.activeSegment.nextOffset,
+		Producers:  l.producers,
+		Txns:       l.txns,
+		Aborted:    l.aborted,
+		Origins:    l.origins,
+		Assignment: l.assignment,
+	})
+}
+
+// writeGob atomically replaces the named file with v's gob encoding.
+func writeGob(name string, v interface{}) error {
+	f, err := os.OpenFile(name+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// loadState rebuilds the derived state from the last snapshot and the
+// records appended after it.
+func (l *Log) loadState() error {
+	l.producers = make(map[uint64]*producerState)
+	l.txns = make(map[uint64]uint64)
+	l.aborted = nil
+	l.origins = make(map[string]uint64)
+	l.assignment = nil
+	off := l.segments[0].baseOffset
+	f, err := os.Open(path.Join(l.Dir, stateFile))
+	switch {
+	case err == nil:
+		state := logState{}
+		err = gob.NewDecoder(f).Decode(&state)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		// gob leaves empty maps nil
+		if state.Producers != nil {
+			l.producers = state.Producers
+		}
+		if state.Txns != nil {
+			l.txns = state.Txns
+			l.findOldestTxn()
+		}
+		l.aborted = state.Aborted
+		// segments removed since the snapshot took their aborted
+		// transactions with them
+		l.trimAborted()
+		if state.Origins != nil {
+			l.origins = state.Origins
+		}
+		l.assignment = state.Assignment
+		if state.Offset > off {
+			off = state.Offset
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	for _, s := range l.segments {
+		if off < s.baseOffset {
+			off = s.baseOffset
+		}
+		for ; off < s.nextOffset; off++ {
+			record, err := s.Read(off)
+			if err != nil {
+				return err
+			}
+			l.track(record)
+		}
+	}
+	return nil
+}
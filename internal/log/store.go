@@ -3,6 +3,7 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"io"
 	"os"
 	"sync"
 )
@@ -77,6 +78,73 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+// Flush writes buffered writes to the store file.
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+// Sync flushes buffered writes and commits the store file to disk.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// Truncate cuts the store down to size bytes.
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	return s.File.Sync()
+}
+
+// Rewrite cuts the store down to size bytes by copying them into a new file
+// that takes the store's place, so hard links to the old file keep what
+// it held.
+func (s *store) Rewrite(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	name := s.File.Name()
+	tmp, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, io.NewSectionReader(s.File, 0, int64(size))); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	// reopened under the store's name, which Name reports
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.File.Close()
+	s.File, s.buf, s.size = f, bufio.NewWriter(f), size
+	return nil
+}
+
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
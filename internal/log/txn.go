@@ -0,0 +1,300 @@
+package log
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"go.uber.org/zap"
+)
+
+// abortedTxn is the range of offsets an aborted transaction spans, up to
+// and including its abort control record.
+type abortedTxn struct {
+	TxnId uint64
+	First uint64
+	Last  uint64
+}
+
+func (l *Log) trackTxn(record *api.Record) {
+	if record.TxnId == 0 {
+		return
+	}
+	first, open := l.txns[record.TxnId]
+	switch record.Control {
+	case api.ControlType_CONTROL_NONE:
+		if !open {
+			l.txns[record.TxnId] = record.Offset
+			if len(l.txns) == 1 || record.Offset < l.oldestTxn {
+				l.oldestTxn = record.Offset
+			}
+		}
+		return
+	case api.ControlType_CONTROL_ABORT:
+		if open {
+			l.aborted = append(l.aborted, abortedTxn{
+				TxnId: record.TxnId,
+				First: first,
+				Last:  record.Offset,
+			})
+		}
+	}
+	delete(l.txns, record.TxnId)
+	if open && first == l.oldestTxn {
+		l.findOldestTxn()
+	}
+}
+
+// findOldestTxn looks for the open transaction that started first, which
+// is only needed when the oldest one ends.
+func (l *Log) findOldestTxn() {
+	found := false
+	for _, first := range l.txns {
+		if !found || first < l.oldestTxn {
+			l.oldestTxn, found = first, true
+		}
+	}
+}
+
+// LastStableOffset returns the offset of the first record of the oldest
+// open transaction, or the next offset when none is open. Every record
+// before it is either committed or aborted.
+func (l *Log) LastStableOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.lastStableOffset()
+}
+
+func (l *Log) lastStableOffset() uint64 {
+	if len(l.txns) > 0 && l.oldestTxn < l.activeSegment.nextOffset {
+		return l.oldestTxn
+	}
+	return l.activeSegment.nextOffset
+}
+
+// ReadCommitted returns the first record at or after off that's below the
+// last stable offset, isn't a control record and wasn't written by an
+// aborted transaction.
+func (l *Log) ReadCommitted(off uint64) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for lso := l.lastStableOffset(); off < lso; off++ {
+		record, err := l.read(off)
+		if err != nil {
+			return nil, err
+		}
+		if record.Control != api.ControlType_CONTROL_NONE || l.isAborted(record) {
+			continue
+		}
+		return record, nil
+	}
+	return nil, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// AppendBatch appends the records together. When one of them can't be
+// appended the ones before it are removed again, so either every record is
+// appended or none is. Readers wait on the log's lock, so they never see a
+// batch that's rolled back.
+func (l *Log) AppendBatch(records []*api.Record) ([]uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	next := l.activeSegment.nextOffset
+	offsets := make([]uint64, 0, len(records))
+	for _, record := range records {
+		off, err := l.append(record)
+		if err != nil {
+			if _, terr := l.truncate(next); terr != nil {
+				return nil, terr
+			}
+			return nil, err
+		}
+		offsets = append(offsets, off)
+	}
+	return offsets, nil
+}
+
+// trimAborted forgets the aborted transactions that ended below the log's
+// lowest offset, since none of their records can be read anymore.
+func (l *Log) trimAborted() {
+	lowest := l.segments[0].baseOffset
+	aborted := l.aborted[:0]
+	for _, a := range l.aborted {
+		if a.Last >= lowest {
+			aborted = append(aborted, a)
+		}
+	}
+	l.aborted = aborted
+}
+
+func (l *Log) isAborted(record *api.Record) bool {
+	if record.TxnId == 0 {
+		return false
+	}
+	for _, a := range l.aborted {
+		if a.TxnId == record.TxnId &&
+			a.First <= record.Offset && record.Offset <= a.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenTxns returns the ids of the transactions without a control record.
+func (l *Log) OpenTxns() []uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var ids []uint64
+	for id := range l.txns {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// TxnCoordinator runs transactions against a log. A transaction's records
+// are appended as they're added and stay hidden from READ_COMMITTED
+// consumers until the coordinator appends a commit control record, or for
+// good once it appends an abort control record. Transactions left open
+// longer than Timeout are aborted.
+type TxnCoordinator struct {
+	Log     *Log
+	Timeout time.Duration
+
+	logger *zap.Logger
+	mu     sync.Mutex
+	// txns maps open transactions to their deadline
+	txns   map[uint64]time.Time
+	closed bool
+	close  chan struct{}
+}
+
+// Begin opens a transaction and returns its id.
+func (t *TxnCoordinator) Begin() (uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	b := make([]byte, 8)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return 0, err
+		}
+		id := binary.BigEndian.Uint64(b)
+		if _, ok := t.txns[id]; id == 0 || ok {
+			continue
+		}
+		t.txns[id] = time.Now().Add(t.timeout())
+		return id, nil
+	}
+}
+
+// Add appends the records as part of the transaction and returns their
+// offsets. The records may belong to different topics. Either every record
+// is added or, when one fails, none is.
+func (t *TxnCoordinator) Add(id uint64, records []*api.Record) ([]uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	if _, ok := t.txns[id]; !ok {
+		return nil, api.ErrTxnNotOpen{TxnId: id}
+	}
+	for _, record := range records {
+		record.TxnId = id
+		record.Control = api.ControlType_CONTROL_NONE
+	}
+	return t.Log.AppendBatch(records)
+}
+
+// Commit makes the transaction's records visible to READ_COMMITTED
+// consumers and returns the offset of the commit control record.
+func (t *TxnCoordinator) Commit(id uint64) (uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	return t.end(id, api.ControlType_CONTROL_COMMIT)
+}
+
+// Abort hides the transaction's records from READ_COMMITTED consumers and
+// returns the offset of the abort control record.
+func (t *TxnCoordinator) Abort(id uint64) (uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.init()
+	return t.end(id, api.ControlType_CONTROL_ABORT)
+}
+
+func (t *TxnCoordinator) end(id uint64, control api.ControlType) (uint64, error) {
+	if _, ok := t.txns[id]; !ok {
+		return 0, api.ErrTxnNotOpen{TxnId: id}
+	}
+	off, err := t.Log.Append(&api.Record{TxnId: id, Control: control})
+	if err != nil {
+		return 0, err
+	}
+	delete(t.txns, id)
+	return off, t.Log.Sync()
+}
+
+// expire aborts the transactions that outlived their deadline.
+func (t *TxnCoordinator) expire() {
+	ticker := time.NewTicker(t.timeout() / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.close:
+			return
+		case now := <-ticker.C:
+			t.mu.Lock()
+			for id, deadline := range t.txns {
+				if now.Before(deadline) {
+					continue
+				}
+				if _, err := t.end(id, api.ControlType_CONTROL_ABORT); err != nil {
+					t.logger.Error(
+						"failed to abort expired transaction",
+						zap.Uint64("txn_id", id),
+						zap.Error(err),
+					)
+				}
+			}
+			t.mu.Unlock()
+		}
+	}
+}
+
+func (t *TxnCoordinator) timeout() time.Duration {
+	if t.Timeout == 0 {
+		return time.Minute
+	}
+	return t.Timeout
+}
+
+// init lazily sets the coordinator up, adopting the transactions the log
+// holds open from before a restart so they eventually expire.
+func (t *TxnCoordinator) init() {
+	if t.logger == nil {
+		t.logger = zap.L().Named("txn")
+	}
+	if t.txns != nil {
+		return
+	}
+	t.txns = make(map[uint64]time.Time)
+	for _, id := range t.Log.OpenTxns() {
+		t.txns[id] = time.Now().Add(t.timeout())
+	}
+	t.close = make(chan struct{})
+	go t.expire()
+}
+
+// Close stops expiring transactions. Open transactions stay open in the log
+// and are picked up by the next coordinator.
+func (t *TxnCoordinator) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.close == nil || t.closed {
+		return nil
+	}
+	t.closed = true
+	close(t.close)
+	return nil
+}
@@ -0,0 +1,477 @@
+package mirror
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"github.com/abdulmajid18/log-distributed-system/internal/backoff"
+	"go.uber.org/zap"
+)
+
+const (
+	// stateFile holds the producer the mirror produces as.
+	stateFile = "mirror.state"
+	// offsetsFile holds the runs of records mirrored, in the order they
+	// were mirrored.
+	offsetsFile = "mirror.offsets"
+	// entryWidth is the size of a run in the offsets file.
+	entryWidth = 24
+	// maxBatch is how many records are produced together. The target only
+	// remembers a producer's last five sequences, so a batch produced
+	// again after a crash is answered with its offsets rather than
+	// failing.
+	maxBatch = 5
+)
+
+var enc = binary.BigEndian
+
+// Mirror copies the committed records of a log in another cluster into the
+// local cluster, so a region's log can be kept in another region for
+// disaster recovery.
+//
+// Records are produced in batches, and the runs of each batch, records at
+// consecutive offsets in both logs, are appended to a file and synced once
+// the batch is produced. Runs continuing the one before are merged, so
+// the file only grows by a run per gap in the offsets once open compacts
+// it. The file is the mirror's checkpoint, since it resumes after the last
+// source offset in it, and it translates offsets so consumers failing over
+// can resume at the equivalent position. Records are produced as an
+// idempotent producer numbering them by how many were mirrored before, so
+// one produced again after a crash isn't duplicated.
+type Mirror struct {
+	// Source is a client of the cluster records are mirrored from. Target
+	// returns a client of the server in the cluster they're produced into
+	// that accepts writes, its leader, and is called again after every
+	// failure in case the leader changed.
+	Source api.LogClient
+	Target func() (api.LogClient, error)
+	// Dir is where the mirror keeps its producer and offsets.
+	Dir string
+	// Start is the source offset the mirror starts at the first time.
+	Start uint64
+	// Topics are the topics mirrored, records of other topics are skipped.
+	// Every topic is mirrored when it's empty.
+	Topics []string
+	// MinBackoff and MaxBackoff bound how long the mirror waits before
+	// retrying after a failure, they default to 100ms and 10s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	logger     *zap.Logger
+	mu         sync.Mutex
+	producerID uint64
+	// runs holds the runs in the offsets file, merged, and sequence how
+	// many records they hold, which is the next record's sequence
+	runs     []run
+	sequence uint64
+	file     *os.File
+}
+
+// run is count records mirrored from consecutive offsets from source on to
+// consecutive offsets from target on.
+type run struct {
+	source uint64
+	target uint64
+	count  uint64
+}
+
+type mirrorState struct {
+	ProducerID uint64
+}
+
+// Run mirrors records until ctx is done, retrying with backoff whenever the
+// source or target fails. It only fails if the mirror's files can't be
+// opened.
+func (m *Mirror) Run(ctx context.Context) error {
+	m.logger = zap.L().Named("mirror")
+	if err := m.open(); err != nil {
+		return err
+	}
+	defer m.close()
+	failures := 0
+	for {
+		mirrored, err := m.mirror(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if mirrored > 0 {
+			failures = 0
+		}
+		failures++
+		m.logger.Error(
+			"failed to mirror",
+			zap.Uint64("offset", m.Next()),
+			zap.Error(err),
+		)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(m.backoff(failures)):
+		}
+	}
+}
+
+// mirror streams the source's committed records into the target until
+// either fails, returning how many records it mirrored.
+func (m *Mirror) mirror(ctx context.Context) (mirrored int, err error) {
+	target, err := m.Target()
+	if err != nil {
+		return 0, err
+	}
+	if err := m.initProducer(ctx, target); err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := m.Source.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:    m.Next(),
+		Isolation: api.IsolationLevel_READ_COMMITTED,
+	})
+	if err != nil {
+		return 0, err
+	}
+	// records are received while the ones before are produced, so those
+	// received meanwhile make up the next batch
+	records := make(chan *api.Record, maxBatch)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			record := res.Record
+			// committed reads skip control records, this is in case the
+			// source serves them anyway
+			if record.Control != api.ControlType_CONTROL_NONE || !m.mirrors(record.Topic) {
+				continue
+			}
+			select {
+			case records <- record:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+	}()
+	for {
+		batch, err := nextBatch(records, errc)
+		if err != nil {
+			return mirrored, err
+		}
+		n, err := m.produce(ctx, target, batch)
+		mirrored += n
+		if err != nil {
+			return mirrored, err
+		}
+	}
+}
+
+// nextBatch waits for a record and takes those received after it, up to
+// maxBatch.
+func nextBatch(records <-chan *api.Record, errc <-chan error) ([]*api.Record, error) {
+	var batch []*api.Record
+	select {
+	case record := <-records:
+		batch = append(batch, record)
+	case err := <-errc:
+		return nil, err
+	}
+	for len(batch) < maxBatch {
+		select {
+		case record := <-records:
+			batch = append(batch, record)
+		default:
+			return batch, nil
+		}
+	}
+	return batch, nil
+}
+
+// produce produces the records to the target on one stream, without
+// waiting for each to be acknowledged before sending the next, and
+// checkpoints those that were. It returns how many were.
+func (m *Mirror) produce(ctx context.Context, target api.LogClient, records []*api.Record) (int, error) {
+	stream, err := target.ProduceStream(ctx)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	sequence := m.sequence
+	m.mu.Unlock()
+	for i, record := range records {
+		// a transaction's records only reach the mirror once it's
+		// committed, so they're produced on their own, without TxnId
+		if err = stream.Send(&api.ProduceRequest{
+			Record: &api.Record{
+				Value:     record.Value,
+				Key:       record.Key,
+				Headers:   record.Headers,
+				Timestamp: record.Timestamp,
+				Topic:     record.Topic,
+			},
+			Acks:       api.Acks_ACKS_ALL,
+			ProducerId: m.producerID,
+			Sequence:   sequence + uint64(i),
+		}); err != nil {
+			return 0, err
+		}
+	}
+	if err = stream.CloseSend(); err != nil {
+		return 0, err
+	}
+	var produced []run
+	for _, record := range records {
+		res, rerr := stream.Recv()
+		if rerr != nil {
+			err = rerr
+			break
+		}
+		produced = append(produced, run{
+			source: record.Offset,
+			target: res.Offset,
+			count:  1,
+		})
+	}
+	if aerr := m.add(produced); aerr != nil {
+		return 0, aerr
+	}
+	return len(produced), err
+}
+
+// mirrors reports whether records of the topic are mirrored.
+func (m *Mirror) mirrors(topic string) bool {
+	if len(m.Topics) == 0 {
+		return true
+	}
+	for _, t := range m.Topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// initProducer gets the mirror a producer id on the target the first time
+// it runs.
+func (m *Mirror) initProducer(ctx context.Context, target api.LogClient) error {
+	if m.producerID != 0 {
+		return nil
+	}
+	res, err := target.InitProducer(ctx, &api.InitProducerRequest{})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(
+		path.Join(m.Dir, stateFile+".tmp"),
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(f).Encode(mirrorState{ProducerID: res.ProducerId}); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(
+		path.Join(m.Dir, stateFile+".tmp"),
+		path.Join(m.Dir, stateFile),
+	); err != nil {
+		return err
+	}
+	m.producerID = res.ProducerId
+	return nil
+}
+
+// Next returns the source offset the mirror resumes at.
+func (m *Mirror) Next() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.runs) == 0 {
+		return m.Start
+	}
+	last := m.runs[len(m.runs)-1]
+	return last.source + last.count
+}
+
+// Translate returns the target offset of the first mirrored record at or
+// after the source offset, where a consumer that would've read the source
+// at that offset resumes on the target. Past the last mirrored record it's
+// the target offset after that record. It fails with
+// api.ErrOffsetOutOfRange while nothing has been mirrored.
+func (m *Mirror) Translate(offset uint64) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.runs) == 0 {
+		return 0, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	i := sort.Search(len(m.runs), func(i int) bool {
+		return m.runs[i].source+m.runs[i].count > offset
+	})
+	if i == len(m.runs) {
+		last := m.runs[i-1]
+		return last.target + last.count, nil
+	}
+	if r := m.runs[i]; offset > r.source {
+		return r.target + offset - r.source, nil
+	}
+	return m.runs[i].target, nil
+}
+
+// add checkpoints the records of a batch, writing a run for each gap in
+// their offsets.
+func (m *Mirror) add(produced []run) error {
+	if len(produced) == 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	runs := merge(nil, produced)
+	b := make([]byte, 0, len(runs)*entryWidth)
+	for _, r := range runs {
+		b = appendRun(b, r)
+	}
+	if _, err := m.file.Write(b); err != nil {
+		return err
+	}
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+	m.runs = merge(m.runs, runs)
+	m.sequence += uint64(len(produced))
+	return nil
+}
+
+// merge appends the runs to runs, extending the last one by those that
+// continue it.
+func merge(runs []run, add []run) []run {
+	for _, r := range add {
+		if n := len(runs); n > 0 {
+			last := &runs[n-1]
+			if r.source == last.source+last.count && r.target == last.target+last.count {
+				last.count += r.count
+				continue
+			}
+		}
+		runs = append(runs, r)
+	}
+	return runs
+}
+
+func appendRun(b []byte, r run) []byte {
+	var e [entryWidth]byte
+	enc.PutUint64(e[:], r.source)
+	enc.PutUint64(e[8:], r.target)
+	enc.PutUint64(e[16:], r.count)
+	return append(b, e[:]...)
+}
+
+// open loads the producer and the runs mirrored before, dropping a run
+// only partly written when the process stopped. The offsets file is
+// rewritten with the runs merged when any continue the one before.
+func (m *Mirror) open() error {
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+	state, err := os.Open(path.Join(m.Dir, stateFile))
+	switch {
+	case err == nil:
+		var s mirrorState
+		err = gob.NewDecoder(state).Decode(&s)
+		state.Close()
+		if err != nil {
+			return err
+		}
+		m.producerID = s.ProducerID
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	name := path.Join(m.Dir, offsetsFile)
+	b, err := ioutil.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	n := len(b) / entryWidth * entryWidth
+	var runs []run
+	for i := 0; i < n; i += entryWidth {
+		runs = merge(runs, []run{{
+			source: enc.Uint64(b[i:]),
+			target: enc.Uint64(b[i+8:]),
+			count:  enc.Uint64(b[i+16:]),
+		}})
+	}
+	if len(runs)*entryWidth != len(b) {
+		compacted := make([]byte, 0, len(runs)*entryWidth)
+		for _, r := range runs {
+			compacted = appendRun(compacted, r)
+		}
+		if err = writeFile(name, compacted); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs = runs
+	m.sequence = 0
+	for _, r := range runs {
+		m.sequence += r.count
+	}
+	m.file = f
+	return nil
+}
+
+// writeFile replaces the named file with one holding b, synced before it
+// takes the file's place.
+func writeFile(name string, b []byte) error {
+	f, err := os.OpenFile(name+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func (m *Mirror) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.file.Sync(); err != nil {
+		m.file.Close()
+		return err
+	}
+	return m.file.Close()
+}
+
+// backoff is how long to wait before retrying after failures in a row.
+func (m *Mirror) backoff(failures int) time.Duration {
+	return backoff.Wait(failures, m.MinBackoff, m.MaxBackoff)
+}
@@ -0,0 +1,328 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// source serves its records to a single consumer.
+type source struct {
+	api.LogClient
+	records []*api.Record
+	// offsets records the offset of every stream opened
+	offsets []uint64
+}
+
+func (s *source) ConsumeStream(
+	ctx context.Context,
+	req *api.ConsumeRequest,
+	_ ...grpc.CallOption,
+) (api.Log_ConsumeStreamClient, error) {
+	s.offsets = append(s.offsets, req.Offset)
+	var records []*api.Record
+	for _, record := range s.records {
+		if record.Offset >= req.Offset {
+			records = append(records, record)
+		}
+	}
+	return &stream{ctx: ctx, records: records}, nil
+}
+
+type stream struct {
+	grpc.ClientStream
+	ctx     context.Context
+	records []*api.Record
+}
+
+func (s *stream) Recv() (*api.ConsumeResponse, error) {
+	if len(s.records) == 0 {
+		<-s.ctx.Done()
+		return nil, s.ctx.Err()
+	}
+	record := s.records[0]
+	s.records = s.records[1:]
+	return &api.ConsumeResponse{Record: record}, nil
+}
+
+// target appends what's produced to it, recognising retried sequences.
+type target struct {
+	api.LogClient
+	mu        sync.Mutex
+	base      uint64
+	records   []*api.Record
+	sequences map[uint64]uint64
+}
+
+func (t *target) InitProducer(
+	context.Context,
+	*api.InitProducerRequest,
+	...grpc.CallOption,
+) (*api.InitProducerResponse, error) {
+	return &api.InitProducerResponse{ProducerId: 1}, nil
+}
+
+func (t *target) Produce(
+	_ context.Context,
+	req *api.ProduceRequest,
+	_ ...grpc.CallOption,
+) (*api.ProduceResponse, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sequences == nil {
+		t.sequences = make(map[uint64]uint64)
+	}
+	if off, ok := t.sequences[req.Sequence]; ok {
+		return &api.ProduceResponse{Offset: off}, nil
+	}
+	off := t.base + uint64(len(t.records))
+	t.records = append(t.records, req.Record)
+	t.sequences[req.Sequence] = off
+	return &api.ProduceResponse{Offset: off}, nil
+}
+
+func (t *target) ProduceStream(
+	ctx context.Context,
+	_ ...grpc.CallOption,
+) (api.Log_ProduceStreamClient, error) {
+	return &produceStream{ctx: ctx, produce: t.Produce}, nil
+}
+
+// produceStream answers every record sent with produce.
+type produceStream struct {
+	grpc.ClientStream
+	ctx     context.Context
+	produce func(context.Context, *api.ProduceRequest, ...grpc.CallOption) (*api.ProduceResponse, error)
+	results []produceResult
+}
+
+type produceResult struct {
+	res *api.ProduceResponse
+	err error
+}
+
+func (s *produceStream) Send(req *api.ProduceRequest) error {
+	res, err := s.produce(s.ctx, req)
+	s.results = append(s.results, produceResult{res, err})
+	return nil
+}
+
+func (s *produceStream) CloseSend() error { return nil }
+
+func (s *produceStream) Recv() (*api.ProduceResponse, error) {
+	if len(s.results) == 0 {
+		return nil, io.EOF
+	}
+	r := s.results[0]
+	s.results = s.results[1:]
+	return r.res, r.err
+}
+
+func (t *target) client() (api.LogClient, error) {
+	return t, nil
+}
+
+func (t *target) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.records)
+}
+
+func TestMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// aborted transactions leave gaps in the committed records
+	src := &source{records: []*api.Record{
+		{Offset: 0, Value: []byte("a")},
+		{Offset: 2, Value: []byte("b"), Key: []byte("k")},
+		{Offset: 5, Value: []byte("c")},
+	}}
+	dst := &target{base: 10}
+	// run mirrors until the mirror resumes at next
+	run := func(next uint64) *Mirror {
+		m := &Mirror{Source: src, Target: dst.client, Dir: dir}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- m.Run(ctx) }()
+		require.Eventually(t, func() bool {
+			return m.Next() == next
+		}, 3*time.Second, 10*time.Millisecond)
+		cancel()
+		require.NoError(t, <-done)
+		return m
+	}
+
+	m := run(6)
+	require.Equal(t, 3, dst.len())
+	require.Equal(t, []byte("k"), dst.records[1].Key)
+	require.Equal(t, uint64(0), dst.records[0].Offset)
+	for _, want := range []struct {
+		source, target uint64
+	}{
+		{source: 0, target: 10},
+		{source: 1, target: 11},
+		{source: 2, target: 11},
+		{source: 5, target: 12},
+		{source: 6, target: 13},
+	} {
+		got, err := m.Translate(want.source)
+		require.NoError(t, err)
+		require.Equal(t, want.target, got, "source offset %d", want.source)
+	}
+
+	// the offsets file only holds a run per gap
+	name := path.Join(dir, offsetsFile)
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	require.Equal(t, int64(3*entryWidth), info.Size())
+
+	// a run half written when the mirror stopped is dropped, and the
+	// record it was for produced again without duplicating it
+	require.NoError(t, os.Truncate(name, 2*entryWidth+4))
+	src.records = append(src.records, &api.Record{Offset: 6, Value: []byte("d")})
+	src.offsets = nil
+
+	m = run(7)
+	require.Equal(t, []uint64{3}, src.offsets)
+	require.Equal(t, 4, dst.len())
+	got, err := m.Translate(6)
+	require.NoError(t, err)
+	require.Equal(t, uint64(13), got)
+}
+
+func TestMirrorRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// records at consecutive offsets are checkpointed as one run, however
+	// they were batched
+	src := &source{}
+	for i := uint64(0); i < 20; i++ {
+		src.records = append(src.records, &api.Record{Offset: i, Value: []byte("a")})
+	}
+	dst := &target{base: 100}
+	m := &Mirror{Source: src, Target: dst.client, Dir: dir}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+	require.Eventually(t, func() bool {
+		return m.Next() == 20
+	}, 3*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	require.Equal(t, 20, dst.len())
+	require.Equal(t, []run{{source: 0, target: 100, count: 20}}, m.runs)
+	got, err := m.Translate(7)
+	require.NoError(t, err)
+	require.Equal(t, uint64(107), got)
+
+	// open compacts the runs the batches wrote
+	m = &Mirror{Dir: dir}
+	require.NoError(t, m.open())
+	require.NoError(t, m.close())
+	info, err := os.Stat(path.Join(dir, offsetsFile))
+	require.NoError(t, err)
+	require.Equal(t, int64(entryWidth), info.Size())
+	require.Equal(t, uint64(20), m.sequence)
+}
+
+func TestMirrorTopics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := &source{records: []*api.Record{
+		{Offset: 0, Value: []byte("a"), Topic: "orders"},
+		{Offset: 1, Value: []byte("b"), Topic: "clicks"},
+		{Offset: 2, Value: []byte("c"), Topic: "orders", TxnId: 1},
+		{Offset: 3, TxnId: 1, Control: api.ControlType_CONTROL_COMMIT},
+	}}
+	dst := &target{}
+	m := &Mirror{Source: src, Target: dst.client, Dir: dir, Topics: []string{"orders"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+	require.Eventually(t, func() bool {
+		return m.Next() == 3
+	}, 3*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	// only the allowed topic's records are produced, keeping their topic
+	// but not the transaction they were committed in
+	require.Equal(t, 2, dst.len())
+	for _, record := range dst.records {
+		require.Equal(t, "orders", record.Topic)
+		require.Zero(t, record.TxnId)
+	}
+}
+
+// follower refuses writes since it isn't the leader.
+type follower struct {
+	target
+}
+
+func (f *follower) ProduceStream(
+	ctx context.Context,
+	_ ...grpc.CallOption,
+) (api.Log_ProduceStreamClient, error) {
+	return &produceStream{ctx: ctx, produce: f.Produce}, nil
+}
+
+func (f *follower) Produce(
+	context.Context,
+	*api.ProduceRequest,
+	...grpc.CallOption,
+) (*api.ProduceResponse, error) {
+	return nil, api.ErrNotLeader{Leader: "leader", Addr: "127.0.0.1:1"}
+}
+
+func TestMirrorLeaderChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := &source{records: []*api.Record{{Offset: 0, Value: []byte("a")}}}
+	dst := &target{}
+	// the mirror first reaches a follower, then finds the leader
+	calls := 0
+	m := &Mirror{
+		Source: src,
+		Target: func() (api.LogClient, error) {
+			calls++
+			if calls == 1 {
+				return &follower{}, nil
+			}
+			return dst, nil
+		},
+		Dir:        dir,
+		MinBackoff: time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+	require.Eventually(t, func() bool {
+		return m.Next() == 1
+	}, 3*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	require.Equal(t, 1, dst.len())
+}
+
+func TestTranslateNothingMirrored(t *testing.T) {
+	m := &Mirror{}
+	_, err := m.Translate(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+}
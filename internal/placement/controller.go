@@ -0,0 +1,420 @@
+package placement
+
+import (
+	"sort"
+	"sync"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Controller assigns the leader and replicas of each partition to the
+// cluster's voting servers, spreading each partition's replicas across
+// zones and every server's share of replicas and leaders evenly.
+//
+// When servers join or fail the controller only repairs the assignment:
+// partitions losing a replica or their leader get new ones and partitions
+// short of replicas are filled, everything else stays put. Moving
+// partitions to balance the cluster is left to a plan made with Plan, which
+// nothing acts on until it's executed.
+type Controller struct {
+	// Partitions is how many partitions are assigned.
+	Partitions int
+	// ReplicationFactor is how many servers hold each partition, it
+	// defaults to 3 and is capped by the number of voting servers.
+	ReplicationFactor int
+	// Servers lists the servers partitions may be assigned to, only alive
+	// voters are used.
+	Servers func() ([]*api.Server, error)
+	// Load returns the assignment last saved, if any, and Save keeps every
+	// assignment before the controller moves to it. The controller starts
+	// from the loaded assignment whenever it's asked for or changed, so a
+	// controller taking over from another carries on from the assignment
+	// it left. Without them the assignment lives in memory only.
+	Load func() (*api.Assignment, error)
+	Save func(*api.Assignment) error
+
+	mu         sync.Mutex
+	version    uint64
+	partitions []*api.PartitionAssignment
+	plan       *api.ReassignmentPlan
+}
+
+// Join repairs the assignment once a server joins.
+func (c *Controller) Join(name, addr string) error {
+	return c.Reconcile()
+}
+
+// Leave repairs the assignment once a server leaves or fails.
+func (c *Controller) Leave(name string) error {
+	return c.Reconcile()
+}
+
+// Reconcile repairs the assignment for the servers in the cluster now. Any
+// plan made before is dropped since the cluster it was made for changed.
+func (c *Controller) Reconcile() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.plan = nil
+	if err := c.load(); err != nil {
+		return err
+	}
+	servers, err := c.servers()
+	if err != nil {
+		return err
+	}
+	return c.apply(c.assign(servers, false))
+}
+
+// Assignment returns the current assignment and its version. It's the
+// one in memory if the saved one can't be loaded.
+func (c *Controller) Assignment() *api.Assignment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.load()
+	return &api.Assignment{
+		Version:    c.version,
+		Partitions: clone(c.partitions),
+	}
+}
+
+// Plan proposes a balanced assignment and the moves to reach it without
+// making them. Only the last plan can be executed.
+func (c *Controller) Plan() (*api.ReassignmentPlan, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	servers, err := c.servers()
+	if err != nil {
+		return nil, err
+	}
+	partitions := c.assign(servers, true)
+	c.plan = &api.ReassignmentPlan{
+		Version:    c.version,
+		Partitions: partitions,
+		Moves:      moves(c.partitions, partitions),
+	}
+	return proto.Clone(c.plan).(*api.ReassignmentPlan), nil
+}
+
+// Execute adopts the plan made against the given version. It fails with
+// api.ErrStalePlan if there's no such plan or the assignment or the
+// cluster changed since.
+func (c *Controller) Execute(version uint64) (*api.Assignment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if c.plan == nil || c.plan.Version != version || c.version != version {
+		return nil, api.ErrStalePlan{Version: version}
+	}
+	if err := c.apply(c.plan.Partitions); err != nil {
+		return nil, err
+	}
+	c.plan = nil
+	return &api.Assignment{
+		Version:    c.version,
+		Partitions: clone(c.partitions),
+	}, nil
+}
+
+// load starts from the saved assignment, if there's one.
+func (c *Controller) load() error {
+	if c.Load == nil {
+		return nil
+	}
+	a, err := c.Load()
+	if err != nil || a == nil {
+		return err
+	}
+	c.version, c.partitions = a.Version, clone(a.Partitions)
+	return nil
+}
+
+// apply adopts the partitions' placement, moving to a new version if it
+// changed. The new version is saved first, so it's never handed out
+// unless a controller taking over would load it.
+func (c *Controller) apply(partitions []*api.PartitionAssignment) error {
+	if len(partitions) == len(c.partitions) {
+		same := true
+		for i := range partitions {
+			if !proto.Equal(partitions[i], c.partitions[i]) {
+				same = false
+				break
+			}
+		}
+		if same {
+			return nil
+		}
+	}
+	next := &api.Assignment{
+		Version:    c.version + 1,
+		Partitions: clone(partitions),
+	}
+	if c.Save != nil {
+		if err := c.Save(next); err != nil {
+			return err
+		}
+	}
+	c.version, c.partitions = next.Version, next.Partitions
+	return nil
+}
+
+// servers returns the alive voters, sorted by id.
+func (c *Controller) servers() ([]*api.Server, error) {
+	if c.Servers == nil {
+		return nil, nil
+	}
+	all, err := c.Servers()
+	if err != nil {
+		return nil, err
+	}
+	var voters []*api.Server
+	for _, server := range all {
+		if server.Role == api.Role_ROLE_VOTER {
+			voters = append(voters, server)
+		}
+	}
+	sort.Slice(voters, func(i, j int) bool {
+		return voters[i].Id < voters[j].Id
+	})
+	return voters, nil
+}
+
+// assign places every partition on the servers, starting from the current
+// assignment. Replicas on servers that are gone are replaced, and when
+// balancing, replicas are shifted from the most to the least loaded servers
+// and servers leading more than their share give the excess up.
+func (c *Controller) assign(servers []*api.Server, balance bool) []*api.PartitionAssignment {
+	zones := make(map[string]string, len(servers))
+	for _, server := range servers {
+		zones[server.Id] = server.Zone
+	}
+	rf := c.replicationFactor()
+	if rf > len(servers) {
+		rf = len(servers)
+	}
+
+	partitions := make([]*api.PartitionAssignment, c.Partitions)
+	load := make(map[string]int, len(servers))
+	for p := range partitions {
+		partitions[p] = &api.PartitionAssignment{Partition: uint32(p)}
+		if p >= len(c.partitions) {
+			continue
+		}
+		partitions[p].Leader = c.partitions[p].Leader
+		for _, id := range c.partitions[p].Replicas {
+			if _, ok := zones[id]; ok && len(partitions[p].Replicas) < rf {
+				partitions[p].Replicas = append(partitions[p].Replicas, id)
+				load[id]++
+			}
+		}
+	}
+
+	for _, partition := range partitions {
+		for len(partition.Replicas) < rf {
+			id := leastLoaded(servers, partition.Replicas, zones, load)
+			partition.Replicas = append(partition.Replicas, id)
+			load[id]++
+		}
+	}
+
+	if balance {
+		for shift(partitions, servers, zones, load) {
+		}
+	}
+
+	c.assignLeaders(partitions, len(servers), balance)
+	return partitions
+}
+
+// assignLeaders keeps each partition's leader while it's still a replica
+// and, when balancing, isn't leading more than its share. Other partitions
+// are led by the replica leading the fewest partitions.
+func (c *Controller) assignLeaders(partitions []*api.PartitionAssignment, servers int, balance bool) {
+	leaders := make(map[string]int)
+	for _, partition := range partitions {
+		if contains(partition.Replicas, partition.Leader) {
+			leaders[partition.Leader]++
+		} else {
+			partition.Leader = ""
+		}
+	}
+	if balance && servers > 0 {
+		max := ceilDiv(c.Partitions, servers)
+		for _, partition := range partitions {
+			if partition.Leader != "" && leaders[partition.Leader] > max {
+				leaders[partition.Leader]--
+				partition.Leader = ""
+			}
+		}
+	}
+	for _, partition := range partitions {
+		if partition.Leader != "" || len(partition.Replicas) == 0 {
+			continue
+		}
+		leader := partition.Replicas[0]
+		for _, id := range partition.Replicas[1:] {
+			if leaders[id] < leaders[leader] {
+				leader = id
+			}
+		}
+		partition.Leader = leader
+		leaders[leader]++
+	}
+}
+
+// shift moves one replica from the server holding the most to the one
+// holding the fewest, if they differ by more than one. It prefers a
+// partition the server doesn't lead and never narrows the zones a partition
+// spans. It reports whether a replica moved.
+func shift(
+	partitions []*api.PartitionAssignment,
+	servers []*api.Server,
+	zones map[string]string,
+	load map[string]int,
+) bool {
+	if len(servers) == 0 {
+		return false
+	}
+	hi, lo := servers[0].Id, servers[0].Id
+	for _, server := range servers {
+		if load[server.Id] > load[hi] {
+			hi = server.Id
+		}
+		if load[server.Id] < load[lo] {
+			lo = server.Id
+		}
+	}
+	if load[hi]-load[lo] <= 1 {
+		return false
+	}
+	for _, leading := range []bool{false, true} {
+		for _, partition := range partitions {
+			if (partition.Leader == hi) != leading ||
+				!contains(partition.Replicas, hi) ||
+				contains(partition.Replicas, lo) {
+				continue
+			}
+			others := make(map[string]bool, len(partition.Replicas))
+			for _, id := range partition.Replicas {
+				if id != hi {
+					others[zones[id]] = true
+				}
+			}
+			if others[zones[lo]] && !others[zones[hi]] {
+				continue
+			}
+			for i, id := range partition.Replicas {
+				if id == hi {
+					partition.Replicas[i] = lo
+				}
+			}
+			load[hi]--
+			load[lo]++
+			return true
+		}
+	}
+	return false
+}
+
+// leastLoaded picks the server for a partition's next replica: one not
+// holding it yet, in a zone it has no replica in if there's one, holding
+// the fewest replicas.
+func leastLoaded(
+	servers []*api.Server,
+	replicas []string,
+	zones map[string]string,
+	load map[string]int,
+) string {
+	used := make(map[string]bool, len(replicas))
+	for _, id := range replicas {
+		used[zones[id]] = true
+	}
+	var best *api.Server
+	for _, server := range servers {
+		if contains(replicas, server.Id) {
+			continue
+		}
+		if best == nil {
+			best = server
+			continue
+		}
+		newZone, bestNewZone := !used[server.Zone], !used[best.Zone]
+		if newZone != bestNewZone {
+			if newZone {
+				best = server
+			}
+			continue
+		}
+		if load[server.Id] < load[best.Id] {
+			best = server
+		}
+	}
+	return best.Id
+}
+
+// moves lists how each partition's placement changes between two
+// assignments.
+func moves(from, to []*api.PartitionAssignment) []*api.PartitionMove {
+	var moves []*api.PartitionMove
+	for p, partition := range to {
+		var old *api.PartitionAssignment
+		if p < len(from) {
+			old = from[p]
+		} else {
+			old = &api.PartitionAssignment{}
+		}
+		move := &api.PartitionMove{Partition: partition.Partition}
+		for _, id := range partition.Replicas {
+			if !contains(old.Replicas, id) {
+				move.AddReplicas = append(move.AddReplicas, id)
+			}
+		}
+		for _, id := range old.Replicas {
+			if !contains(partition.Replicas, id) {
+				move.RemoveReplicas = append(move.RemoveReplicas, id)
+			}
+		}
+		if old.Leader != partition.Leader {
+			move.FromLeader, move.ToLeader = old.Leader, partition.Leader
+		}
+		if len(move.AddReplicas) > 0 ||
+			len(move.RemoveReplicas) > 0 ||
+			move.ToLeader != "" {
+			moves = append(moves, move)
+		}
+	}
+	return moves
+}
+
+func (c *Controller) replicationFactor() int {
+	if c.ReplicationFactor == 0 {
+		return 3
+	}
+	return c.ReplicationFactor
+}
+
+func clone(partitions []*api.PartitionAssignment) []*api.PartitionAssignment {
+	cloned := make([]*api.PartitionAssignment, len(partitions))
+	for i, partition := range partitions {
+		cloned[i] = proto.Clone(partition).(*api.PartitionAssignment)
+	}
+	return cloned
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,177 @@
+package placement
+
+import (
+	"errors"
+	"testing"
+
+	api "github.com/abdulmajid18/log-distributed-system/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type cluster struct {
+	servers []*api.Server
+}
+
+func (c *cluster) GetServers() ([]*api.Server, error) {
+	return c.servers, nil
+}
+
+func TestController(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		c *Controller,
+		cl *cluster,
+	){
+		"assigns partitions evenly across zones": testAssign,
+		"repairs partitions on failed servers":   testRepair,
+		"plans and executes a rebalance":         testPlanExecute,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			cl := &cluster{servers: []*api.Server{
+				{Id: "0", Zone: "a"},
+				{Id: "1", Zone: "a"},
+				{Id: "2", Zone: "b"},
+				{Id: "3", Zone: "b"},
+				{Id: "4", Zone: "c", Role: api.Role_ROLE_NON_VOTER},
+			}}
+			c := &Controller{
+				Partitions:        8,
+				ReplicationFactor: 2,
+				Servers:           cl.GetServers,
+			}
+			require.NoError(t, c.Reconcile())
+			fn(t, c, cl)
+		})
+	}
+}
+
+func testAssign(t *testing.T, c *Controller, _ *cluster) {
+	a := c.Assignment()
+	require.Equal(t, uint64(1), a.Version)
+	require.Equal(t, 8, len(a.Partitions))
+
+	zones := map[string]string{"0": "a", "1": "a", "2": "b", "3": "b"}
+	replicas, leaders := map[string]int{}, map[string]int{}
+	for _, p := range a.Partitions {
+		require.Equal(t, 2, len(p.Replicas))
+		require.NotEqual(t, zones[p.Replicas[0]], zones[p.Replicas[1]])
+		require.Contains(t, p.Replicas, p.Leader)
+		for _, id := range p.Replicas {
+			replicas[id]++
+		}
+		leaders[p.Leader]++
+	}
+	// the non-voter gets nothing
+	require.Equal(t, map[string]int{"0": 4, "1": 4, "2": 4, "3": 4}, replicas)
+	require.Equal(t, map[string]int{"0": 2, "1": 2, "2": 2, "3": 2}, leaders)
+
+	// nothing changed so the version stays
+	require.NoError(t, c.Reconcile())
+	require.Equal(t, a, c.Assignment())
+}
+
+func testRepair(t *testing.T, c *Controller, cl *cluster) {
+	before := c.Assignment()
+	cl.servers = cl.servers[1:]
+	require.NoError(t, c.Leave("0"))
+
+	after := c.Assignment()
+	require.Equal(t, before.Version+1, after.Version)
+	for i, p := range after.Partitions {
+		require.NotContains(t, p.Replicas, "0")
+		require.Equal(t, 2, len(p.Replicas))
+		require.Contains(t, p.Replicas, p.Leader)
+		// partitions that weren't on the failed server don't move
+		if !contains(before.Partitions[i].Replicas, "0") {
+			require.Equal(t, before.Partitions[i].Replicas, p.Replicas)
+			require.Equal(t, before.Partitions[i].Leader, p.Leader)
+		}
+	}
+}
+
+func testPlanExecute(t *testing.T, c *Controller, cl *cluster) {
+	// a server joining doesn't move fully replicated partitions onto it
+	cl.servers = append(cl.servers, &api.Server{Id: "5", Zone: "c"})
+	require.NoError(t, c.Join("5", ""))
+	before := c.Assignment()
+	require.Equal(t, uint64(1), before.Version)
+	for _, p := range before.Partitions {
+		require.NotContains(t, p.Replicas, "5")
+	}
+
+	plan, err := c.Plan()
+	require.NoError(t, err)
+	require.Equal(t, before.Version, plan.Version)
+	require.NotEmpty(t, plan.Moves)
+	added := 0
+	for _, move := range plan.Moves {
+		for _, id := range move.AddReplicas {
+			if id == "5" {
+				added++
+			}
+		}
+	}
+	require.Equal(t, 3, added)
+	// planning is a dry run
+	require.Equal(t, before, c.Assignment())
+
+	a, err := c.Execute(plan.Version)
+	require.NoError(t, err)
+	require.Equal(t, before.Version+1, a.Version)
+	require.Equal(t, plan.Partitions, a.Partitions)
+
+	// a plan only executes once
+	_, err = c.Execute(plan.Version)
+	require.Equal(t, api.ErrStalePlan{Version: plan.Version}, err)
+
+	// nor once the cluster changed
+	plan, err = c.Plan()
+	require.NoError(t, err)
+	require.NoError(t, c.Leave("4"))
+	_, err = c.Execute(plan.Version)
+	require.Error(t, err)
+}
+
+func TestControllerTakeover(t *testing.T) {
+	cl := &cluster{servers: []*api.Server{
+		{Id: "0", Zone: "a"},
+		{Id: "1", Zone: "b"},
+	}}
+	var saved *api.Assignment
+	newController := func() *Controller {
+		return &Controller{
+			Partitions:        4,
+			ReplicationFactor: 2,
+			Servers:           cl.GetServers,
+			Load: func() (*api.Assignment, error) {
+				return saved, nil
+			},
+			Save: func(a *api.Assignment) error {
+				saved = a
+				return nil
+			},
+		}
+	}
+	c := newController()
+	require.NoError(t, c.Reconcile())
+	cl.servers = append(cl.servers, &api.Server{Id: "2", Zone: "c"})
+	plan, err := c.Plan()
+	require.NoError(t, err)
+	a, err := c.Execute(plan.Version)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), saved.Version)
+
+	// a controller taking over carries on from the saved assignment
+	next := newController()
+	require.Equal(t, a, next.Assignment())
+	require.NoError(t, next.Reconcile())
+	require.Equal(t, a, next.Assignment())
+
+	// an assignment that can't be saved isn't moved to
+	next.Save = func(*api.Assignment) error {
+		return errors.New("can't save")
+	}
+	cl.servers = cl.servers[:2]
+	require.Error(t, next.Reconcile())
+	require.Equal(t, a, next.Assignment())
+}
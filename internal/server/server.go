@@ -2,7 +2,13 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	api "github.com/abdulmajid18/log-distributed-system/api/v1"
@@ -14,6 +20,7 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 	"go.opencensus.io/plugin/ocgrpc"
@@ -29,18 +36,165 @@ type Authorizer interface {
 
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendIf(record *api.Record, expected uint64) (uint64, error)
 	Read(uint64) (*api.Record, error)
+	ReadCommitted(uint64) (*api.Record, error)
+	ReadFrames(off, maxBytes uint64) ([]byte, uint64, error)
+	Wait(ctx context.Context, off uint64) error
+	Snapshot(fn func(name string, r io.Reader) error) error
+	Checksums(from, to, size uint64) ([]*api.Checksum, error)
+	NextOffset() uint64
+	Sync() error
+}
+
+// Transactions coordinates atomic writes of several records.
+type Transactions interface {
+	Begin() (uint64, error)
+	Add(txnID uint64, records []*api.Record) ([]uint64, error)
+	Commit(txnID uint64) (uint64, error)
+	Abort(txnID uint64) (uint64, error)
+}
+
+// Replicas tracks the followers fetching from this server's log.
+type Replicas interface {
+	Fetched(replica string, next uint64)
+	InSync() []string
+	CheckInSync(min int) error
+	WaitForReplicas(ctx context.Context, offset uint64, min int) error
+	Replicas() []*api.Replica
+}
+
+// Leadership picks the one server that accepts writes when replicas keep
+// the offsets of the log they follow.
+type Leadership interface {
+	Leader() (name, addr string, epoch uint64)
+	IsLeader() bool
+	TransferLeadership(name string) error
+	AppointLeader(name string) error
+}
+
+// Membership is the server's membership of its cluster.
+type Membership interface {
+	Leave() error
+}
+
+// GetServerer lists the servers in the cluster.
+type GetServerer interface {
+	GetServers() ([]*api.Server, error)
+}
+
+// Mirror translates the offsets of a log mirrored from another cluster
+// into the local log's.
+type Mirror interface {
+	Translate(offset uint64) (uint64, error)
+}
+
+// Keyring changes the keys membership gossip is encrypted with across the
+// cluster.
+type Keyring interface {
+	InstallKey(key string) (*api.KeyringResponse, error)
+	UseKey(key string) (*api.KeyringResponse, error)
+	RemoveKey(key string) (*api.KeyringResponse, error)
+	ListKeys() (*api.KeyringResponse, error)
+}
+
+// MemberWatcher streams changes to the cluster's membership.
+type MemberWatcher interface {
+	Watch(current bool) (events <-chan *api.MemberEvent, cancel func())
+}
+
+// Chain orders the servers into a replication chain. Writes enter at its
+// head, the leader, ACKS_ALL produces are acknowledged once its tail holds
+// them and consistent reads are served by its tail.
+type Chain interface {
+	Length() int
+	Tail() (name, addr string)
+	IsTail() bool
+	// Reported records the tail's progress a replica acknowledged with.
+	Reported(replica string, tail uint64)
+	WaitForTail(ctx context.Context, next uint64) error
+}
+
+// ClusterConfig holds the settings changed at runtime across the cluster,
+// which override the server's own.
+type ClusterConfig interface {
+	ClusterConfig() *api.ClusterConfig
+	SetClusterConfig(config *api.ClusterConfig) (*api.ClusterConfig, error)
+	ConfigVersions() map[string]uint64
+}
+
+// Placement assigns partitions to the cluster's servers, moving them only
+// when a reviewed plan is executed.
+type Placement interface {
+	Assignment() *api.Assignment
+	Plan() (*api.ReassignmentPlan, error)
+	Execute(version uint64) (*api.Assignment, error)
 }
 
 type Config struct {
-	CommitLog  CommitLog
-	Authorizer Authorizer
+	CommitLog    CommitLog
+	Authorizer   Authorizer
+	Replicas     Replicas
+	Transactions Transactions
+	// Leadership is nil when every server accepts writes.
+	Leadership  Leadership
+	Membership  Membership
+	GetServerer GetServerer
+	// Placement is nil when partitions aren't assigned. Only the leader's
+	// assignment is served.
+	Placement Placement
+	// Mirror is nil when the server doesn't mirror another cluster.
+	Mirror Mirror
+	// Keyring and MemberWatcher are nil when the server has no membership.
+	Keyring       Keyring
+	MemberWatcher MemberWatcher
+	// Chain is nil unless the servers replicate along a chain, which
+	// needs Leadership. With a chain MinInSyncReplicas bounds its length.
+	Chain Chain
+	// ClusterConfig is nil when settings can't be changed at runtime. Its
+	// settings override MinInSyncReplicas, MaxHeaders and MaxHeaderBytes,
+	// its ACL grants what the Authorizer doesn't and its quota limits
+	// producers.
+	ClusterConfig ClusterConfig
+	// MinInSyncReplicas is how many replicas, this server included, must
+	// hold a record before an ACKS_ALL produce succeeds.
+	MinInSyncReplicas int
+	// AckTimeout bounds how long an ACKS_ALL produce waits for replicas.
+	AckTimeout time.Duration
+	// ReadLease is how recently the in-sync replicas must have acknowledged
+	// the leader for it to serve linearizable reads, it defaults to one
+	// second.
+	ReadLease time.Duration
+	// MaxHeaders and MaxHeaderBytes limit the headers a produced record
+	// may carry, they default to 64 headers and 16KiB of keys and values.
+	MaxHeaders     int
+	MaxHeaderBytes int
 }
 
 const (
 	objectWildcard = "*"
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	adminAction    = "admin"
+	// replicateAction lets a subject replicate as a replica named other
+	// than itself, the replica's id being the object
+	replicateAction = "replicate"
+)
+
+const (
+	// defaultReplicateBytes is the batch size Replicate uses when the
+	// replica doesn't ask for one.
+	defaultReplicateBytes = 1 << 20
+	// replicateWindow is how many batches Replicate sends ahead of the
+	// replica's acknowledgements.
+	replicateWindow = 4
+	// minSegmentIndexBytes fits a single index entry.
+	minSegmentIndexBytes = 12
+	// replicateIdle is how often Replicate reports a caught up replica as
+	// fetched while there's nothing new to send.
+	replicateIdle = 100 * time.Millisecond
+	// snapshotChunkBytes is how much of a file each SnapshotChunk holds.
+	snapshotChunkBytes = 1 << 20
 )
 
 // var _ api.LogServer = (*grpcServer)(nil)
@@ -48,6 +202,16 @@ const (
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+
+	mu sync.Mutex
+	// draining refuses new replicas while the server is decommissioned
+	draining bool
+
+	// produced counts the bytes each subject produced during second, for
+	// the cluster's produce quota
+	quotaMu  sync.Mutex
+	second   int64
+	produced map[string]uint64
 }
 
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
@@ -137,36 +301,406 @@ func subject(ctx context.Context) string {
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	if err := s.Authorizer.Authorize(
+	if err := s.authorize(
 		subject(ctx),
 		objectWildcard,
 		produceAction,
 	); err != nil {
 		return nil, err
 	}
-	offset, err := s.CommitLog.Append(req.Record)
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := s.validateRecord(req.Record); err != nil {
+		return nil, err
+	}
+	// only transactions and replication set these, a producer setting
+	// them would open a transaction nothing ends or spoof another origin
+	if r := req.Record; r.TxnId != 0 || r.Origin != "" || r.OriginSequence != 0 {
+		return nil, status.Error(
+			codes.InvalidArgument,
+			"records can't set txn_id, origin or origin_sequence",
+		)
+	}
+	if err := s.checkQuota(subject(ctx), req.Record); err != nil {
+		return nil, err
+	}
+	if req.ProducerId != 0 {
+		req.Record.ProducerId = req.ProducerId
+		req.Record.Sequence = req.Sequence
+	}
+	if req.Acks == api.Acks_ACKS_ALL {
+		// fail before appending so the producer can safely retry
+		if err := s.checkInSync(); err != nil {
+			return nil, err
+		}
+	}
+	var offset uint64
+	var err error
+	if req.ExpectedOffset != nil {
+		offset, err = s.CommitLog.AppendIf(req.Record, *req.ExpectedOffset)
+	} else {
+		offset, err = s.CommitLog.Append(req.Record)
+	}
 	if err != nil {
 		return nil, err
 	}
-
+	if req.Acks == api.Acks_ACKS_NONE {
+		return &api.ProduceResponse{Offset: offset}, nil
+	}
+	if err = s.CommitLog.Sync(); err != nil {
+		return nil, err
+	}
+	if req.Acks == api.Acks_ACKS_ALL {
+		// the record is appended by now, so the producer is told a retry
+		// would append it again
+		if err = s.waitForReplicas(ctx, offset); err != nil {
+			return nil, api.ErrUnconfirmed{
+				Offset: offset,
+				Reason: status.Convert(err).Message(),
+			}
+		}
+	}
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
+func (s *grpcServer) validateRecord(record *api.Record) error {
+	if record == nil {
+		return status.Error(codes.InvalidArgument, "record is required")
+	}
+	// only the servers write control records
+	if record.Control != api.ControlType_CONTROL_NONE {
+		return status.Error(codes.InvalidArgument, "records can't be control records")
+	}
+	maxHeaders, maxHeaderBytes := s.MaxHeaders, s.MaxHeaderBytes
+	if s.ClusterConfig != nil {
+		c := s.ClusterConfig.ClusterConfig()
+		if c.MaxHeaders > 0 {
+			maxHeaders = int(c.MaxHeaders)
+		}
+		if c.MaxHeaderBytes > 0 {
+			maxHeaderBytes = int(c.MaxHeaderBytes)
+		}
+	}
+	if maxHeaders == 0 {
+		maxHeaders = 64
+	}
+	if maxHeaderBytes == 0 {
+		maxHeaderBytes = 16 * 1024
+	}
+	if len(record.Headers) > maxHeaders {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"record has %d headers, at most %d are allowed",
+			len(record.Headers),
+			maxHeaders,
+		)
+	}
+	size := 0
+	for _, h := range record.Headers {
+		if h.Key == "" {
+			return status.Error(codes.InvalidArgument, "header keys can't be empty")
+		}
+		size += len(h.Key) + len(h.Value)
+	}
+	if size > maxHeaderBytes {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"record headers are %d bytes, at most %d are allowed",
+			size,
+			maxHeaderBytes,
+		)
+	}
+	return nil
+}
+
+// InitProducer allocates an id for an idempotent producer. Ids are random
+// so producers writing to different servers don't collide.
+func (s *grpcServer) InitProducer(ctx context.Context, req *api.InitProducerRequest) (*api.InitProducerResponse, error) {
+	if err := s.authorize(
+		subject(ctx),
+		objectWildcard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 8)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if id := binary.BigEndian.Uint64(b); id != 0 {
+			return &api.InitProducerResponse{ProducerId: id}, nil
+		}
+	}
+}
+
+func (s *grpcServer) BeginTxn(ctx context.Context, req *api.BeginTxnRequest) (*api.BeginTxnResponse, error) {
+	if err := s.authorizeTxn(ctx); err != nil {
+		return nil, err
+	}
+	id, err := s.Transactions.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &api.BeginTxnResponse{TxnId: id}, nil
+}
+
+func (s *grpcServer) AddRecords(ctx context.Context, req *api.AddRecordsRequest) (*api.AddRecordsResponse, error) {
+	if err := s.authorizeTxn(ctx); err != nil {
+		return nil, err
+	}
+	for _, record := range req.Records {
+		if err := s.validateRecord(record); err != nil {
+			return nil, err
+		}
+		// the log stamps its own origin, the coordinator the txn id
+		record.Origin, record.OriginSequence = "", 0
+	}
+	offsets, err := s.Transactions.Add(req.TxnId, req.Records)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AddRecordsResponse{Offsets: offsets}, nil
+}
+
+func (s *grpcServer) CommitTxn(ctx context.Context, req *api.EndTxnRequest) (*api.EndTxnResponse, error) {
+	if err := s.authorizeTxn(ctx); err != nil {
+		return nil, err
+	}
+	offset, err := s.Transactions.Commit(req.TxnId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.EndTxnResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) AbortTxn(ctx context.Context, req *api.EndTxnRequest) (*api.EndTxnResponse, error) {
+	if err := s.authorizeTxn(ctx); err != nil {
+		return nil, err
+	}
+	offset, err := s.Transactions.Abort(req.TxnId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.EndTxnResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) authorizeTxn(ctx context.Context) error {
+	if err := s.authorize(
+		subject(ctx),
+		objectWildcard,
+		produceAction,
+	); err != nil {
+		return err
+	}
+	if s.Transactions == nil {
+		return status.Error(codes.Unimplemented, "transactions aren't enabled")
+	}
+	return s.checkWritable()
+}
+
+// checkLeader fails writes to a server that isn't the leader.
+func (s *grpcServer) checkLeader() error {
+	if s.Leadership == nil || s.Leadership.IsLeader() {
+		return nil
+	}
+	return s.notLeader()
+}
+
+// checkWritable fails writes to a server that isn't the leader or is being
+// decommissioned.
+func (s *grpcServer) checkWritable() error {
+	s.mu.Lock()
+	draining := s.draining
+	s.mu.Unlock()
+	if draining {
+		return status.Error(codes.Unavailable, "server is being decommissioned")
+	}
+	return s.checkLeader()
+}
+
+func (s *grpcServer) notLeader() error {
+	name, addr, _ := s.Leadership.Leader()
+	return api.ErrNotLeader{Leader: name, Addr: addr}
+}
+
+// checkConsistency fails reads the server can't serve at the requested
+// consistency. Every server is the leader when there's no leadership.
+//
+// A leader only serves linearizable reads while it holds its lease: enough
+// in-sync voters to acknowledge a write must have acknowledged what they
+// replicated from it within ReadLease. Followers only replicate from and
+// acknowledge the leader they know, and wait out the lease they granted one
+// leader before acknowledging the next, so another leader can't have
+// acknowledged ACKS_ALL writes this one hasn't seen. The epoch mustn't
+// change while that's checked. The read index is then the end of the local
+// log, so the read is served from it right away. Followers' leases must be
+// at least ReadLease, and clocks mustn't drift apart by much within one.
+func (s *grpcServer) checkConsistency(consistency api.Consistency) error {
+	if consistency == api.Consistency_CONSISTENCY_LOCAL {
+		return nil
+	}
+	if s.Chain != nil {
+		return s.checkTail()
+	}
+	if s.Leadership == nil {
+		return nil
+	}
+	_, _, epoch := s.Leadership.Leader()
+	if err := s.checkLeader(); err != nil {
+		return err
+	}
+	if consistency != api.Consistency_CONSISTENCY_LINEARIZABLE {
+		return nil
+	}
+	held := 1
+	if s.Replicas != nil {
+		for _, r := range s.Replicas.Replicas() {
+			lastFetch := time.Unix(0, r.LastFetch)
+			if r.Voter && r.InSync && time.Since(lastFetch) <= s.readLease() {
+				held++
+			}
+		}
+	}
+	if min := s.minInSyncReplicas(); held < min {
+		return api.ErrNotEnoughReplicas{Required: min, InSync: held}
+	}
+	if _, _, e := s.Leadership.Leader(); e != epoch || !s.Leadership.IsLeader() {
+		return s.notLeader()
+	}
+	return nil
+}
+
+// checkTail fails consistent reads on servers other than the chain's tail.
+// Everything the tail holds went through the whole chain, so it serves
+// linearizable reads without a lease.
+func (s *grpcServer) checkTail() error {
+	if s.Chain.IsTail() {
+		return nil
+	}
+	name, addr := s.Chain.Tail()
+	return api.ErrNotChainTail{Tail: name, Addr: addr}
+}
+
+func (s *grpcServer) readLease() time.Duration {
+	if s.ReadLease == 0 {
+		return time.Second
+	}
+	return s.ReadLease
+}
+
+func (s *grpcServer) minInSyncReplicas() int {
+	if s.ClusterConfig != nil {
+		if min := s.ClusterConfig.ClusterConfig().MinInSyncReplicas; min > 0 {
+			return int(min)
+		}
+	}
+	if s.MinInSyncReplicas < 1 {
+		return 1
+	}
+	return s.MinInSyncReplicas
+}
+
+func (s *grpcServer) checkInSync() error {
+	min := s.minInSyncReplicas()
+	inSync := 1
+	switch {
+	case s.Chain != nil:
+		// every server in the chain holds what the tail acknowledges
+		inSync = s.Chain.Length()
+	case s.Replicas != nil:
+		// zones count the same way they do once the record is appended
+		return s.Replicas.CheckInSync(min)
+	}
+	if inSync < min {
+		return api.ErrNotEnoughReplicas{Required: min, InSync: inSync}
+	}
+	return nil
+}
+
+func (s *grpcServer) waitForReplicas(ctx context.Context, offset uint64) error {
+	if s.Replicas == nil && s.Chain == nil {
+		return s.checkInSync()
+	}
+	if s.AckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.AckTimeout)
+		defer cancel()
+	}
+	if s.Chain != nil {
+		if err := s.Chain.WaitForTail(ctx, offset+1); err != nil {
+			return status.Errorf(
+				status.FromContextError(err).Code(),
+				"the chain's tail didn't hold it: %v",
+				err,
+			)
+		}
+		return nil
+	}
+	return s.Replicas.WaitForReplicas(ctx, offset, s.minInSyncReplicas())
+}
+
+// GetReplicas reports how far behind the log each follower is and whether
+// it's in the in-sync replica set.
+func (s *grpcServer) GetReplicas(ctx context.Context, req *api.GetReplicasRequest) (*api.GetReplicasResponse, error) {
+	if err := s.authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	res := &api.GetReplicasResponse{NextOffset: s.CommitLog.NextOffset()}
+	if s.Replicas != nil {
+		res.Replicas = s.Replicas.Replicas()
+	}
+	return res, nil
+}
+
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	if err := s.Authorizer.Authorize(
+	if err := s.authorize(
 		subject(ctx),
 		objectWildcard,
 		produceAction,
 	); err != nil {
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	if err := s.checkConsistency(req.Consistency); err != nil {
+		return nil, err
+	}
+	record, err := s.read(req)
 	if err != nil {
 		return nil, err
 	}
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+// read returns the first record at or after the requested offset that the
+// request's isolation level and topic let it see. Assignment records are
+// the cluster's, so no isolation level sees them. Once it runs out of
+// records the api.ErrOffsetOutOfRange names the offset it got to.
+func (s *grpcServer) read(req *api.ConsumeRequest) (*api.Record, error) {
+	off := req.Offset
+	for {
+		var record *api.Record
+		var err error
+		if req.Isolation == api.IsolationLevel_READ_COMMITTED {
+			record, err = s.CommitLog.ReadCommitted(off)
+		} else {
+			record, err = s.CommitLog.Read(off)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record.Control != api.ControlType_CONTROL_ASSIGNMENT &&
+			(req.Topic == "" || record.Topic == req.Topic) {
+			return record, nil
+		}
+		off = record.Offset + 1
+	}
+}
+
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
@@ -183,28 +717,676 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	}
 }
 
+// ConsumeStream streams the records from the requested offset on. A replica
+// consuming the stream is only tracked as holding the records before the
+// offset it asked for, since it doesn't acknowledge what it's sent.
+// Replicas acknowledging writes replicate with Replicate instead.
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	ctx := stream.Context()
+	if err := s.authorizeReplica(ctx, req.ReplicaId); err != nil {
+		return err
+	}
+	if err := s.checkDraining(req.ReplicaId); err != nil {
+		return err
+	}
+	s.fetched(req.ReplicaId, req.Offset)
+	for {
+		res, err := s.Consume(ctx, req)
+		switch e := err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			// records other topics wrote, and for committed reads control
+			// and aborted records, needn't be read again
+			if e.Offset > req.Offset {
+				req.Offset = e.Offset
+			}
+			s.waitToConsume(ctx, req)
+			if ctx.Err() != nil {
+				return nil
+			}
+			continue
+		default:
+			return err
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+		// committed reads may skip records
+		req.Offset = res.Record.Offset + 1
+	}
+}
+
+// waitToConsume blocks until the log may hold the record the stream asks
+// for next, or for replicateIdle so the stream notices it's done.
+func (s *grpcServer) waitToConsume(ctx context.Context, req *api.ConsumeRequest) {
+	off := req.Offset
+	if req.Isolation == api.IsolationLevel_READ_COMMITTED {
+		// the last stable offset only moves when a record is appended
+		if next := s.CommitLog.NextOffset(); next > off {
+			off = next
+		}
+	}
+	wait, cancel := context.WithTimeout(ctx, replicateIdle)
+	defer cancel()
+	_ = s.CommitLog.Wait(wait, off)
+}
+
+// Replicate streams the log to a replica in batches of raw store frames.
+// Batches are sent without waiting for each to be acknowledged, up to
+// replicateWindow ahead, and the replica's progress is tracked from its
+// acknowledgements only, which it also sends while it's caught up.
+func (s *grpcServer) Replicate(stream api.Log_ReplicateServer) error {
+	ctx := stream.Context()
+	if err := s.authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return err
+	}
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if err = s.authorizeReplica(ctx, req.ReplicaId); err != nil {
+		return err
+	}
+	if err = s.checkDraining(req.ReplicaId); err != nil {
+		return err
+	}
+	maxBytes := req.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultReplicateBytes
+	}
+
+	// window holds a slot for every batch in flight and ends their end
+	// offsets, oldest first. A replica acknowledges with its next offset,
+	// which may cover several batches at once.
+	var (
+		endsMu sync.Mutex
+		ends   []uint64
+	)
+	window := make(chan struct{}, replicateWindow)
+	acks := make(chan error, 1)
+	go func() {
+		for {
+			ack, err := stream.Recv()
+			if err != nil {
+				acks <- err
+				return
+			}
+			if s.Chain != nil {
+				s.Chain.Reported(req.ReplicaId, ack.ChainTail)
+			}
+			s.fetched(req.ReplicaId, ack.Offset)
+			endsMu.Lock()
+			for len(ends) > 0 && ends[0] <= ack.Offset {
+				ends = ends[1:]
+				<-window
+			}
+			endsMu.Unlock()
+		}
+	}()
+
+	off := req.Offset
 	for {
+		frames, n, err := s.CommitLog.ReadFrames(off, maxBytes)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			wait, cancel := context.WithTimeout(ctx, replicateIdle)
+			_ = s.CommitLog.Wait(wait, off)
+			cancel()
+			if ctx.Err() != nil {
+				return nil
+			}
+			continue
+		default:
+			return err
+		}
 		select {
-		case <-stream.Context().Done():
+		case window <- struct{}{}:
+		case err := <-acks:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
 			return nil
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
+		}
+		endsMu.Lock()
+		ends = append(ends, off+n)
+		endsMu.Unlock()
+		if err = stream.Send(&api.ReplicateResponse{
+			Offset: off,
+			Count:  n,
+			Frames: frames,
+		}); err != nil {
+			return err
+		}
+		off += n
+	}
+}
+
+// GetSnapshot streams a point-in-time copy of the log's files so a new
+// replica can start from it instead of replicating every record.
+func (s *grpcServer) GetSnapshot(req *api.GetSnapshotRequest, stream api.Log_GetSnapshotServer) error {
+	if err := s.authorize(
+		subject(stream.Context()),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return err
+	}
+	buf := make([]byte, snapshotChunkBytes)
+	return s.CommitLog.Snapshot(func(name string, r io.Reader) error {
+		for first := true; ; first = false {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 || first {
+				if err := stream.Send(&api.SnapshotChunk{
+					Name: name,
+					Data: buf[:n],
+				}); err != nil {
+					return err
+				}
+			}
+			switch err {
 			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
+			case io.EOF, io.ErrUnexpectedEOF:
+				return nil
 			default:
 				return err
 			}
-			if err = stream.Send(res); err != nil {
+		}
+	})
+}
+
+// GetChecksums hashes ranges of the log so replicas can check they hold the
+// same records without fetching them.
+func (s *grpcServer) GetChecksums(ctx context.Context, req *api.GetChecksumsRequest) (*api.GetChecksumsResponse, error) {
+	if err := s.authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	// records appended meanwhile aren't covered, so the checksums match the
+	// next offset reported with them
+	res := &api.GetChecksumsResponse{NextOffset: s.CommitLog.NextOffset()}
+	to := req.ToOffset
+	if to == 0 || to > res.NextOffset {
+		to = res.NextOffset
+	}
+	if req.FromOffset >= to {
+		return res, nil
+	}
+	sums, err := s.CommitLog.Checksums(req.FromOffset, to, req.RangeSize)
+	if err != nil {
+		return nil, err
+	}
+	res.Checksums = sums
+	return res, nil
+}
+
+// TransferLeadership makes the named server the leader. Only the leader
+// hands over, and only to an in-sync replica so no acknowledged write is
+// lost. Forced, any server appoints the node once the leader is dead.
+func (s *grpcServer) TransferLeadership(ctx context.Context, req *api.TransferLeadershipRequest) (*api.TransferLeadershipResponse, error) {
+	if err := s.authorize(
+		subject(ctx),
+		objectWildcard,
+		adminAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Leadership == nil {
+		return nil, status.Error(codes.Unimplemented, "leadership isn't enabled")
+	}
+	if req.Force {
+		if err := s.Leadership.AppointLeader(req.Node); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		leader, _, epoch := s.Leadership.Leader()
+		return &api.TransferLeadershipResponse{Leader: leader, Epoch: epoch}, nil
+	}
+	if !s.Leadership.IsLeader() {
+		return nil, s.notLeader()
+	}
+	if !s.inSync(req.Node) {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"%s isn't an in-sync replica",
+			req.Node,
+		)
+	}
+	if err := s.Leadership.TransferLeadership(req.Node); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	leader, _, epoch := s.Leadership.Leader()
+	return &api.TransferLeadershipResponse{Leader: leader, Epoch: epoch}, nil
+}
+
+func (s *grpcServer) inSync(replica string) bool {
+	if s.Replicas == nil {
+		return false
+	}
+	for _, id := range s.Replicas.InSync() {
+		if id == replica {
+			return true
+		}
+	}
+	return false
+}
+
+// Decommission takes the server out of the cluster without losing writes:
+// it refuses new replicas and writes, waits for the in-sync replicas to
+// hold every record and, when it leads, hands leadership to the most caught
+// up of them. Then it leaves the cluster, reporting each step.
+func (s *grpcServer) Decommission(req *api.DecommissionRequest, stream api.Log_DecommissionServer) error {
+	ctx := stream.Context()
+	if err := s.authorize(
+		subject(ctx),
+		objectWildcard,
+		adminAction,
+	); err != nil {
+		return err
+	}
+	if s.Membership == nil {
+		return status.Error(codes.Unimplemented, "membership isn't enabled")
+	}
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+	progress := &api.DecommissionProgress{Phase: api.DecommissionPhase_DECOMMISSION_DRAINING}
+	if err := stream.Send(progress); err != nil {
+		return err
+	}
+
+	switch {
+	case s.Leadership == nil:
+		// every server replicates the records this one took
+		if _, err := s.waitInSync(ctx, stream, progress, false); err != nil {
+			return err
+		}
+	case s.Leadership.IsLeader():
+		target, err := s.waitInSync(ctx, stream, progress, true)
+		if err != nil {
+			return err
+		}
+		if err := s.Leadership.TransferLeadership(target); err != nil {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		progress.Phase = api.DecommissionPhase_DECOMMISSION_TRANSFERRING
+		progress.Leader = target
+		if err := stream.Send(progress); err != nil {
+			return err
+		}
+	}
+
+	progress.Phase = api.DecommissionPhase_DECOMMISSION_LEAVING
+	if err := stream.Send(progress); err != nil {
+		return err
+	}
+	if err := s.Membership.Leave(); err != nil {
+		return err
+	}
+	progress.Phase = api.DecommissionPhase_DECOMMISSION_DONE
+	return stream.Send(progress)
+}
+
+// waitInSync waits for enough in-sync replicas to hold every record, which
+// no longer changes once writes are refused. A follower has nothing to wait
+// for, since replicas only replicate from the leader. With transfer set it
+// also waits for a voter to hand leadership to and returns it.
+func (s *grpcServer) waitInSync(
+	ctx context.Context,
+	stream api.Log_DecommissionServer,
+	progress *api.DecommissionProgress,
+	transfer bool,
+) (string, error) {
+	progress.Phase = api.DecommissionPhase_DECOMMISSION_WAITING
+	ticker := time.NewTicker(replicateIdle)
+	defer ticker.Stop()
+	for {
+		inSync, maxLag := s.inSyncLag()
+		progress.InSync, progress.MaxLag = uint32(inSync), maxLag
+		if err := stream.Send(progress); err != nil {
+			return "", err
+		}
+		target := s.transferTarget()
+		if (target != "" || !transfer) &&
+			maxLag == 0 &&
+			inSync >= s.minInSyncReplicas()-1 {
+			return target, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// transferTarget returns the in-sync replica that's furthest along.
+func (s *grpcServer) transferTarget() string {
+	if s.Replicas == nil {
+		return ""
+	}
+	var target *api.Replica
+	for _, r := range s.Replicas.Replicas() {
+		if r.Voter && r.InSync && (target == nil || r.NextOffset > target.NextOffset) {
+			target = r
+		}
+	}
+	if target == nil {
+		return ""
+	}
+	return target.Id
+}
+
+// inSyncLag returns how many replicas are in sync and how far behind the
+// furthest of them is.
+func (s *grpcServer) inSyncLag() (inSync int, maxLag uint64) {
+	if s.Replicas == nil {
+		return 0, 0
+	}
+	for _, r := range s.Replicas.Replicas() {
+		if !r.Voter || !r.InSync {
+			continue
+		}
+		inSync++
+		if r.Lag > maxLag {
+			maxLag = r.Lag
+		}
+	}
+	return inSync, maxLag
+}
+
+// GetServers lists the servers in the cluster, which of them leads and
+// which only serve reads. Servers in the client's zone come first, so it
+// can keep its reads in the zone.
+func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
+	if err := s.authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.GetServerer == nil {
+		return nil, status.Error(codes.Unimplemented, "membership isn't enabled")
+	}
+	servers, err := s.GetServerer.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	if req.Zone != "" {
+		sort.SliceStable(servers, func(i, j int) bool {
+			return servers[i].Zone == req.Zone && servers[j].Zone != req.Zone
+		})
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+// GetAssignment returns where every partition is placed.
+func (s *grpcServer) GetAssignment(ctx context.Context, req *api.GetAssignmentRequest) (*api.Assignment, error) {
+	if err := s.authorizePlacement(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	return s.Placement.Assignment(), nil
+}
+
+// PlanReassignment proposes a balanced assignment without moving anything,
+// so the moves can be reviewed before they're executed.
+func (s *grpcServer) PlanReassignment(ctx context.Context, req *api.PlanReassignmentRequest) (*api.ReassignmentPlan, error) {
+	if err := s.authorizePlacement(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	return s.Placement.Plan()
+}
+
+// ExecuteReassignment adopts the last plan, as long as it was made against
+// the current assignment and cluster.
+func (s *grpcServer) ExecuteReassignment(ctx context.Context, req *api.ExecuteReassignmentRequest) (*api.Assignment, error) {
+	if err := s.authorizePlacement(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	return s.Placement.Execute(req.Version)
+}
+
+// TranslateOffset returns where a consumer failing over from the mirrored
+// cluster resumes on the local log.
+func (s *grpcServer) TranslateOffset(ctx context.Context, req *api.TranslateOffsetRequest) (*api.TranslateOffsetResponse, error) {
+	if err := s.authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Mirror == nil {
+		return nil, status.Error(codes.Unimplemented, "the server doesn't mirror a cluster")
+	}
+	off, err := s.Mirror.Translate(req.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return &api.TranslateOffsetResponse{Offset: off}, nil
+}
+
+// Keyring lists or changes the gossip encryption keys of every member.
+// Keys are rotated without downtime by installing the new key, using it and
+// then removing the old one.
+func (s *grpcServer) Keyring(ctx context.Context, req *api.KeyringRequest) (*api.KeyringResponse, error) {
+	if err := s.authorize(
+		subject(ctx),
+		objectWildcard,
+		adminAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Config.Keyring == nil {
+		return nil, status.Error(codes.Unimplemented, "membership isn't enabled")
+	}
+	if req.Operation == api.KeyringOperation_KEYRING_LIST {
+		return s.Config.Keyring.ListKeys()
+	}
+	key, err := base64.StdEncoding.DecodeString(req.Key)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "the key isn't base64 encoded")
+	}
+	if n := len(key); n != 16 && n != 24 && n != 32 {
+		return nil, status.Errorf(codes.InvalidArgument, "the key is %d bytes, not 16, 24 or 32", n)
+	}
+	switch req.Operation {
+	case api.KeyringOperation_KEYRING_INSTALL:
+		return s.Config.Keyring.InstallKey(req.Key)
+	case api.KeyringOperation_KEYRING_USE:
+		return s.Config.Keyring.UseKey(req.Key)
+	case api.KeyringOperation_KEYRING_REMOVE:
+		return s.Config.Keyring.RemoveKey(req.Key)
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "unknown keyring operation %d", req.Operation)
+}
+
+// WatchMembers streams an event for every member joining, leaving, failing
+// or changing its tags. A client falling too far behind is cut off with
+// ResourceExhausted and must watch again.
+func (s *grpcServer) WatchMembers(req *api.WatchMembersRequest, stream api.Log_WatchMembersServer) error {
+	if err := s.authorize(
+		subject(stream.Context()),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return err
+	}
+	if s.MemberWatcher == nil {
+		return status.Error(codes.Unimplemented, "membership isn't enabled")
+	}
+	events, cancel := s.MemberWatcher.Watch(req.Current)
+	defer cancel()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "fell behind the membership's changes")
+			}
+			if err := stream.Send(event); err != nil {
 				return err
 			}
-			req.Offset++
 		}
 	}
 }
 
+// GetClusterConfig returns the cluster's config as this server applied it,
+// and the version every server applied.
+func (s *grpcServer) GetClusterConfig(ctx context.Context, req *api.GetClusterConfigRequest) (*api.GetClusterConfigResponse, error) {
+	if err := s.authorizeClusterConfig(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	return &api.GetClusterConfigResponse{
+		Config:   s.ClusterConfig.ClusterConfig(),
+		Versions: s.ClusterConfig.ConfigVersions(),
+	}, nil
+}
+
+// SetClusterConfig changes the config of every server in the cluster. The
+// change is made against the config's version and fails if another change
+// was made since. Only the leader makes changes, so they're ordered.
+func (s *grpcServer) SetClusterConfig(ctx context.Context, req *api.SetClusterConfigRequest) (*api.ClusterConfig, error) {
+	if err := s.authorizeClusterConfig(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	config := req.Config
+	if config == nil {
+		return nil, status.Error(codes.InvalidArgument, "config is required")
+	}
+	if n := config.MaxSegmentIndexBytes; n != 0 && n < minSegmentIndexBytes {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"max_segment_index_bytes is %d, segments need at least %d",
+			n,
+			minSegmentIndexBytes,
+		)
+	}
+	for _, rule := range config.Acl {
+		if rule.Subject == "" || rule.Object == "" || rule.Action == "" {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				"acl rules need a subject, object and action",
+			)
+		}
+	}
+	return s.ClusterConfig.SetClusterConfig(config)
+}
+
+func (s *grpcServer) authorizeClusterConfig(ctx context.Context, action string) error {
+	if err := s.authorize(
+		subject(ctx),
+		objectWildcard,
+		action,
+	); err != nil {
+		return err
+	}
+	if s.ClusterConfig == nil {
+		return status.Error(codes.Unimplemented, "cluster config isn't enabled")
+	}
+	return nil
+}
+
+func (s *grpcServer) authorizePlacement(ctx context.Context, action string) error {
+	if err := s.authorize(
+		subject(ctx),
+		objectWildcard,
+		action,
+	); err != nil {
+		return err
+	}
+	if s.Placement == nil {
+		return status.Error(codes.Unimplemented, "partitions aren't assigned")
+	}
+	return s.checkLeader()
+}
+
+// authorize checks the subject may perform the action on the object, as
+// either the server's policy or the cluster config's ACL allows.
+func (s *grpcServer) authorize(subject, object, action string) error {
+	err := s.Authorizer.Authorize(subject, object, action)
+	if err == nil || s.ClusterConfig == nil {
+		return err
+	}
+	for _, rule := range s.ClusterConfig.ClusterConfig().Acl {
+		if rule.Subject == subject &&
+			(rule.Object == object || rule.Object == objectWildcard) &&
+			rule.Action == action {
+			return nil
+		}
+	}
+	return err
+}
+
+// checkQuota counts the record towards the bytes the subject produced
+// this second, failing once they'd exceed the cluster's produce quota.
+func (s *grpcServer) checkQuota(subject string, record *api.Record) error {
+	if s.ClusterConfig == nil {
+		return nil
+	}
+	quota := s.ClusterConfig.ClusterConfig().ProduceQuotaBytes
+	if quota == 0 {
+		return nil
+	}
+	n := uint64(proto.Size(record))
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	if now := time.Now().Unix(); now != s.second || s.produced == nil {
+		s.second, s.produced = now, make(map[string]uint64)
+	}
+	if s.produced[subject]+n > quota {
+		return status.Errorf(
+			codes.ResourceExhausted,
+			"%s exceeded the produce quota of %d bytes per second",
+			subject,
+			quota,
+		)
+	}
+	s.produced[subject] += n
+	return nil
+}
+
+// authorizeReplica checks the caller may report the named replica's
+// progress: a replica is named after the subject of its certificate, unless
+// the subject is allowed to replicate as it.
+func (s *grpcServer) authorizeReplica(ctx context.Context, replica string) error {
+	if replica == "" || replica == subject(ctx) {
+		return nil
+	}
+	return s.authorize(subject(ctx), replica, replicateAction)
+}
+
+func (s *grpcServer) checkDraining(replica string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining && replica != "" {
+		return status.Error(codes.Unavailable, "server is being decommissioned")
+	}
+	return nil
+}
+
+// fetched records a replica's progress once it reported holding everything
+// before next.
+func (s *grpcServer) fetched(replica string, next uint64) {
+	if s.Replicas == nil || replica == "" {
+		return
+	}
+	s.Replicas.Fetched(replica, next)
+}
+
 // func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (
 // 	*grpc.Server,
 // 	error,
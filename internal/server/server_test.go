@@ -3,23 +3,29 @@ package server
 import (
 	"context"
 	"flag"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	api "github.com/abdulmajid18/log-distributed-system/api/v1"
 	"github.com/abdulmajid18/log-distributed-system/internal/auth"
+	"github.com/abdulmajid18/log-distributed-system/internal/chain"
 	"github.com/abdulmajid18/log-distributed-system/internal/config"
 	"github.com/abdulmajid18/log-distributed-system/internal/log"
+	"github.com/abdulmajid18/log-distributed-system/internal/placement"
 	"github.com/stretchr/testify/require"
 	"go.opencensus.io/examples/exporter"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 var debug = flag.Bool("debug", false, "Enable observablity for debuging.")
@@ -46,6 +52,26 @@ func TestServer(t *testing.T) {
 		"produce/consume stream succeeds":                     testProduceConsumeStream,
 		"consume past log boundary fails":                     testConsumePastBoundary,
 		"unauthorized fails":                                  testUnauthorized,
+		"produce with acks all waits for in-sync replicas":    testProduceAcksAll,
+		"produce with acks all reports unconfirmed appends":   testProduceAcksAllUnconfirmed,
+		"idempotent producer retry keeps its offset":          testIdempotentProduce,
+		"read committed hides open transactions":              testTransaction,
+		"record key, headers and timestamps round trip":       testRecordEnvelope,
+		"produce at an unexpected offset fails":               testProduceExpectedOffset,
+		"get replicas reports follower lag":                   testGetReplicas,
+		"replicate streams batches of frames":                 testReplicate,
+		"replicate acks free every batch they cover":          testReplicateWindow,
+		"get snapshot streams the log's files":                testGetSnapshot,
+		"get checksums hashes ranges of the log":              testGetChecksums,
+		"consume checks the requested consistency":            testConsumeConsistency,
+		"produce with acks all spans zones":                   testProduceAcksAllZones,
+		"get servers lists the client's zone first":           testGetServersZone,
+		"reassignment is planned before it's executed":        testReassignment,
+		"translate offset maps mirrored offsets":              testTranslateOffset,
+		"keyring changes need valid keys and admins":          testKeyring,
+		"watch members streams membership changes":            testWatchMembers,
+		"cluster config overrides the server's settings":      testClusterConfig,
+		"chain replication waits for the tail":                testChainReplication,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient, nobodyClient, config, teardown := setupTest(t, nil)
@@ -143,8 +169,11 @@ func setupTest(t *testing.T, fn func(*Config)) (
 		require.NoError(t, err)
 	}
 	cfg = &Config{
-		CommitLog:  clog,
-		Authorizer: authorizer,
+		CommitLog:    clog,
+		Authorizer:   authorizer,
+		Replicas:     &log.ReplicaTracker{Log: clog},
+		Transactions: &log.TxnCoordinator{Log: clog},
+		AckTimeout:   3 * time.Second,
 	}
 	if fn != nil {
 		fn(cfg)
@@ -262,9 +291,11 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Con
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
+			require.NotZero(t, res.Record.AppendTime)
 			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
+				Value:      record.Value,
+				Offset:     uint64(i),
+				AppendTime: res.Record.AppendTime,
 			})
 		}
 	}
@@ -570,3 +601,870 @@ func testUnauthorized(t *testing.T, _, client api.LogClient, config *Config) {
 // 		t.Fatalf("Expected %s but got %s", want, got)
 // 	}
 // }
+
+func testProduceAcksAll(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config.MinInSyncReplicas = 2
+
+	// no follower is fetching yet so the produce fails without appending
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Acks:   api.Acks_ACKS_ALL,
+	})
+	got := status.Code(err)
+	want := status.Code(api.ErrNotEnoughReplicas{}.GRPCStatus().Err())
+	require.Equal(t, want, got)
+
+	// a replica consuming the log isn't counted for what it's sent
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:    0,
+		ReplicaId: "consumer",
+	})
+	require.NoError(t, err)
+
+	follow(ctx, t, client, "follower", 0)
+	require.Eventually(t, func() bool {
+		return len(config.Replicas.InSync()) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Acks:   api.Acks_ACKS_ALL,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+	for _, r := range config.Replicas.Replicas() {
+		if r.Id == "consumer" {
+			require.Equal(t, uint64(0), r.NextOffset)
+		}
+	}
+}
+
+// follow replicates the log as the named replica in the background,
+// acknowledging every batch, until ctx is done.
+func follow(ctx context.Context, t *testing.T, client api.LogClient, id string, from uint64) {
+	stream, err := client.Replicate(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ReplicateRequest{
+		Offset:    from,
+		ReplicaId: id,
+	}))
+	// a caught up replica acknowledges without a batch
+	require.NoError(t, stream.Send(&api.ReplicateRequest{Offset: from}))
+	go func() {
+		for {
+			batch, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			next := batch.Offset + batch.Count
+			if err = stream.Send(&api.ReplicateRequest{Offset: next}); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func testProduceAcksAllUnconfirmed(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	config.MinInSyncReplicas = 2
+	config.AckTimeout = 100 * time.Millisecond
+
+	// the follower is in sync but never fetches the record, so it's
+	// appended without being confirmed
+	config.Replicas.Fetched("follower", 0)
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Acks:   api.Acks_ACKS_ALL,
+	})
+	st := status.Convert(err)
+	require.Equal(t, codes.DeadlineExceeded, st.Code())
+	var offset string
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			offset = info.Metadata["offset"]
+		}
+	}
+	require.Equal(t, "0", offset)
+
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+}
+
+func testIdempotentProduce(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	producer, err := client.InitProducer(ctx, &api.InitProducerRequest{})
+	require.NoError(t, err)
+	require.NotZero(t, producer.ProducerId)
+
+	req := &api.ProduceRequest{
+		Record:     &api.Record{Value: []byte("hello world")},
+		ProducerId: producer.ProducerId,
+		Sequence:   0,
+	}
+	first, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	retry, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, first.Offset, retry.Offset)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: first.Offset + 1})
+	require.Error(t, err)
+}
+
+func testTransaction(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	txn, err := client.BeginTxn(ctx, &api.BeginTxnRequest{})
+	require.NoError(t, err)
+	_, err = client.AddRecords(ctx, &api.AddRecordsRequest{
+		TxnId: txn.TxnId,
+		Records: []*api.Record{
+			{Value: []byte("first message"), Topic: "orders"},
+			{Value: []byte("second message"), Topic: "outbox"},
+		},
+	})
+	require.NoError(t, err)
+
+	committed := &api.ConsumeRequest{
+		Offset:    0,
+		Isolation: api.IsolationLevel_READ_COMMITTED,
+	}
+	_, err = client.Consume(ctx, committed)
+	got := status.Code(err)
+	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+	require.Equal(t, want, got)
+
+	end, err := client.CommitTxn(ctx, &api.EndTxnRequest{TxnId: txn.TxnId})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), end.Offset)
+
+	consume, err := client.Consume(ctx, committed)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first message"), consume.Record.Value)
+
+	// both topics' records were committed together
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:    0,
+		Isolation: api.IsolationLevel_READ_COMMITTED,
+		Topic:     "outbox",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("second message"), consume.Record.Value)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:    consume.Record.Offset + 1,
+		Isolation: api.IsolationLevel_READ_COMMITTED,
+		Topic:     "outbox",
+	})
+	require.Equal(t, want, status.Code(err))
+
+	// read uncommitted consumers see the control record
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{Offset: end.Offset})
+	require.NoError(t, err)
+	require.Equal(t, api.ControlType_CONTROL_COMMIT, consume.Record.Control)
+}
+
+func testRecordEnvelope(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	want := &api.Record{
+		Value:     []byte("hello world"),
+		Key:       []byte("user-1"),
+		Headers:   []*api.Header{{Key: "content-type", Value: []byte("text/plain")}},
+		Timestamp: time.Now().UnixNano(),
+	}
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: want})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, want.Key, consume.Record.Key)
+	require.Equal(t, want.Timestamp, consume.Record.Timestamp)
+	require.Len(t, consume.Record.Headers, 1)
+	require.Equal(t, want.Headers[0].Key, consume.Record.Headers[0].Key)
+	require.Equal(t, want.Headers[0].Value, consume.Record.Headers[0].Value)
+	require.NotZero(t, consume.Record.AppendTime)
+
+	// producers can't forge the servers' control records, nor fields
+	// only transactions and replication set
+	for _, record := range []*api.Record{
+		{Value: []byte("hello world"), Control: api.ControlType_CONTROL_ASSIGNMENT},
+		{Value: []byte("hello world"), TxnId: 42},
+		{Value: []byte("hello world"), Origin: "other"},
+		{Value: []byte("hello world"), OriginSequence: 1},
+	} {
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: record})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+
+	config.MaxHeaderBytes = 8
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: want})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testProduceExpectedOffset(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	expected := uint64(0)
+	req := &api.ProduceRequest{
+		Record:         &api.Record{Value: []byte("hello world")},
+		ExpectedOffset: &expected,
+	}
+	produce, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, expected, produce.Offset)
+
+	_, err = client.Produce(ctx, req)
+	st := status.Convert(err)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	var actual string
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			actual = info.Metadata["actual_offset"]
+		}
+	}
+	require.Equal(t, "1", actual)
+
+	// the cluster's assignment records are hidden from writers and readers
+	clog := config.CommitLog.(*log.Log)
+	require.NoError(t, clog.AppendAssignment(&api.Assignment{Version: 1}))
+	expected = 1
+	produce, err = client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), produce.Offset)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), consume.Record.Offset)
+}
+
+func testGetReplicas(t *testing.T, client, nobody api.LogClient, config *Config) {
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	// a follower that never caught up isn't in sync
+	config.Replicas.Fetched("follower", 1)
+	res, err := client.GetReplicas(ctx, &api.GetReplicasRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.NextOffset)
+	require.Equal(t, 1, len(res.Replicas))
+	require.Equal(t, "follower", res.Replicas[0].Id)
+	require.Equal(t, uint64(1), res.Replicas[0].Lag)
+	require.False(t, res.Replicas[0].InSync)
+
+	config.Replicas.Fetched("follower", 2)
+	res, err = client.GetReplicas(ctx, &api.GetReplicasRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Replicas[0].Lag)
+	require.True(t, res.Replicas[0].InSync)
+
+	_, err = nobody.GetReplicas(ctx, &api.GetReplicasRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testReplicate(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err := client.Replicate(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ReplicateRequest{
+		Offset:    0,
+		ReplicaId: "follower",
+	}))
+	// batches are sent ahead of acknowledgements
+	var next uint64
+	for next < 3 {
+		batch, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, next, batch.Offset)
+		require.NotZero(t, batch.Count)
+		require.NotEmpty(t, batch.Frames)
+		next += batch.Count
+	}
+	require.NoError(t, stream.Send(&api.ReplicateRequest{Offset: next}))
+	require.Eventually(t, func() bool {
+		replicas := config.Replicas.Replicas()
+		return len(replicas) == 1 && replicas[0].NextOffset == next
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// new records are streamed as they're appended
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	batch, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, next, batch.Offset)
+}
+
+func testReplicateWindow(t *testing.T, client, _ api.LogClient, config *Config) {
+	// a leaked window stalls the stream rather than failing it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Replicate(ctx)
+	require.NoError(t, err)
+	// every batch holds a single record
+	require.NoError(t, stream.Send(&api.ReplicateRequest{
+		ReplicaId: "follower",
+		MaxBytes:  1,
+	}))
+	// each acknowledgement covers two batches, which only keeps the stream
+	// going if it frees both
+	var next uint64
+	for round := 0; round < 3*replicateWindow; round++ {
+		for i := 0; i < 2; i++ {
+			_, err = client.Produce(ctx, &api.ProduceRequest{
+				Record: &api.Record{Value: []byte("hello world")},
+			})
+			require.NoError(t, err)
+			batch, err := stream.Recv()
+			require.NoError(t, err)
+			require.Equal(t, next, batch.Offset)
+			next += batch.Count
+		}
+		require.NoError(t, stream.Send(&api.ReplicateRequest{Offset: next}))
+	}
+}
+
+func testGetSnapshot(t *testing.T, client, nobody api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	stream, err := client.GetSnapshot(ctx, &api.GetSnapshotRequest{})
+	require.NoError(t, err)
+	files := make(map[string]int)
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		files[chunk.Name] += len(chunk.Data)
+	}
+	require.NotZero(t, files["0.store"])
+	require.NotZero(t, files["0.index"])
+	require.Contains(t, files, "state.snapshot")
+
+	stream, err = nobody.GetSnapshot(ctx, &api.GetSnapshotRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testGetChecksums(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := client.GetChecksums(ctx, &api.GetChecksumsRequest{RangeSize: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.NextOffset)
+	require.Equal(t, 2, len(res.Checksums))
+	require.Equal(t, uint64(2), res.Checksums[0].NextOffset)
+	require.Equal(t, uint64(3), res.Checksums[1].NextOffset)
+
+	records, err := client.GetChecksums(ctx, &api.GetChecksumsRequest{
+		FromOffset: 1,
+		ToOffset:   2,
+		RangeSize:  1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records.Checksums))
+	require.Equal(t, uint64(1), records.Checksums[0].FirstOffset)
+	require.NotEqual(t, res.Checksums[0].Sum, records.Checksums[0].Sum)
+}
+
+// leadership is a fixed view of the cluster's leader.
+type leadership struct {
+	leader string
+	addr   string
+	epoch  uint64
+	local  bool
+}
+
+func (l *leadership) Leader() (string, string, uint64) {
+	return l.leader, l.addr, l.epoch
+}
+
+func (l *leadership) IsLeader() bool { return l.local }
+
+func (l *leadership) TransferLeadership(string) error { return nil }
+
+func (l *leadership) AppointLeader(string) error { return nil }
+
+func testConsumeConsistency(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	// a follower only serves local reads
+	follower := &leadership{leader: "leader", addr: "127.0.0.1:1", epoch: 1}
+	config.Leadership = follower
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for _, consistency := range []api.Consistency{
+		api.Consistency_CONSISTENCY_LEADER,
+		api.Consistency_CONSISTENCY_LINEARIZABLE,
+	} {
+		_, err = client.Consume(ctx, &api.ConsumeRequest{
+			Offset:      0,
+			Consistency: consistency,
+		})
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	}
+
+	// the leader needs a follower to have fetched recently to hold its
+	// lease
+	config.Leadership = &leadership{leader: "local", epoch: 2, local: true}
+	config.MinInSyncReplicas = 2
+	config.ReadLease = 200 * time.Millisecond
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      0,
+		Consistency: api.Consistency_CONSISTENCY_LEADER,
+	})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      0,
+		Consistency: api.Consistency_CONSISTENCY_LINEARIZABLE,
+	})
+	want := status.Code(api.ErrNotEnoughReplicas{}.GRPCStatus().Err())
+	require.Equal(t, want, status.Code(err))
+
+	config.Replicas.Fetched("follower", 1)
+	res, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      0,
+		Consistency: api.Consistency_CONSISTENCY_LINEARIZABLE,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+
+	// the lease runs out once the follower stops fetching
+	time.Sleep(300 * time.Millisecond)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      0,
+		Consistency: api.Consistency_CONSISTENCY_LINEARIZABLE,
+	})
+	require.Equal(t, want, status.Code(err))
+}
+
+func testProduceAcksAllZones(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config.MinInSyncReplicas = 2
+	tracker := config.Replicas.(*log.ReplicaTracker)
+	tracker.LocalZone = "a"
+	tracker.MinZones = 2
+	tracker.Zone = func(id string) string {
+		return map[string]string{"same": "a", "other": "b"}[id]
+	}
+
+	// a follower in the local zone makes enough replicas but not zones, so
+	// the produce fails without appending
+	config.Replicas.Fetched("same", 0)
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Acks:   api.Acks_ACKS_ALL,
+	})
+	got := status.Code(err)
+	want := status.Code(api.ErrNotEnoughZones{}.GRPCStatus().Err())
+	require.Equal(t, want, got)
+
+	follow(ctx, t, client, "other", 0)
+	require.Eventually(t, func() bool {
+		return len(config.Replicas.InSync()) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Acks:   api.Acks_ACKS_ALL,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+}
+
+// servers is a fixed list of the cluster's servers.
+type servers []*api.Server
+
+func (s servers) GetServers() ([]*api.Server, error) {
+	return append([]*api.Server(nil), s...), nil
+}
+
+func testGetServersZone(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.GetServers(ctx, &api.GetServersRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	config.GetServerer = servers{
+		{Id: "0", Zone: "a", IsLeader: true},
+		{Id: "1", Zone: "b"},
+		{Id: "2", Zone: "a"},
+		{Id: "3", Zone: "b"},
+	}
+	res, err := client.GetServers(ctx, &api.GetServersRequest{Zone: "b"})
+	require.NoError(t, err)
+	var ids []string
+	for _, server := range res.Servers {
+		ids = append(ids, server.Id)
+	}
+	require.Equal(t, []string{"1", "3", "0", "2"}, ids)
+}
+
+func testReassignment(t *testing.T, client, nobody api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.GetAssignment(ctx, &api.GetAssignmentRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	cluster := servers{{Id: "0"}, {Id: "1"}}
+	controller := &placement.Controller{
+		Partitions:        4,
+		ReplicationFactor: 1,
+		Servers:           func() ([]*api.Server, error) { return cluster.GetServers() },
+	}
+	require.NoError(t, controller.Reconcile())
+	config.Placement = controller
+
+	a, err := client.GetAssignment(ctx, &api.GetAssignmentRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), a.Version)
+	require.Equal(t, 4, len(a.Partitions))
+
+	_, err = nobody.PlanReassignment(ctx, &api.PlanReassignmentRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	cluster = append(cluster, &api.Server{Id: "2"}, &api.Server{Id: "3"})
+	require.NoError(t, controller.Join("2", ""))
+	plan, err := client.PlanReassignment(ctx, &api.PlanReassignmentRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(plan.Moves))
+
+	a, err = client.ExecuteReassignment(ctx, &api.ExecuteReassignmentRequest{
+		Version: plan.Version,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), a.Version)
+	var replicas []string
+	for _, p := range a.Partitions {
+		replicas = append(replicas, p.Replicas...)
+	}
+	require.ElementsMatch(t, []string{"0", "1", "2", "3"}, replicas)
+
+	_, err = client.ExecuteReassignment(ctx, &api.ExecuteReassignmentRequest{
+		Version: plan.Version,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+// mirror translates source offsets by adding its shift.
+type mirror uint64
+
+func (m mirror) Translate(offset uint64) (uint64, error) {
+	return offset + uint64(m), nil
+}
+
+func testTranslateOffset(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.TranslateOffset(ctx, &api.TranslateOffsetRequest{Offset: 3})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	config.Mirror = mirror(10)
+	res, err := client.TranslateOffset(ctx, &api.TranslateOffsetRequest{Offset: 3})
+	require.NoError(t, err)
+	require.Equal(t, uint64(13), res.Offset)
+}
+
+// keyring records the keys it's asked to install.
+type keyring struct {
+	installed []string
+}
+
+func (k *keyring) InstallKey(key string) (*api.KeyringResponse, error) {
+	k.installed = append(k.installed, key)
+	return &api.KeyringResponse{Members: 1, Responses: 1}, nil
+}
+
+func (k *keyring) UseKey(string) (*api.KeyringResponse, error) {
+	return &api.KeyringResponse{}, nil
+}
+
+func (k *keyring) RemoveKey(string) (*api.KeyringResponse, error) {
+	return &api.KeyringResponse{}, nil
+}
+
+func (k *keyring) ListKeys() (*api.KeyringResponse, error) {
+	return &api.KeyringResponse{Keys: map[string]int32{"key": 1}}, nil
+}
+
+func testKeyring(t *testing.T, client, nobody api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.Keyring(ctx, &api.KeyringRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	k := &keyring{}
+	config.Keyring = k
+	_, err = nobody.Keyring(ctx, &api.KeyringRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	res, err := client.Keyring(ctx, &api.KeyringRequest{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int32{"key": 1}, res.Keys)
+
+	for _, key := range []string{"not base64!", "c2hvcnQ="} {
+		_, err = client.Keyring(ctx, &api.KeyringRequest{
+			Operation: api.KeyringOperation_KEYRING_INSTALL,
+			Key:       key,
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+
+	key := "AAAAAAAAAAAAAAAAAAAAAA=="
+	res, err = client.Keyring(ctx, &api.KeyringRequest{
+		Operation: api.KeyringOperation_KEYRING_INSTALL,
+		Key:       key,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), res.Responses)
+	require.Equal(t, []string{key}, k.installed)
+}
+
+// watcher hands out a channel the test sends events on.
+type watcher struct {
+	events chan *api.MemberEvent
+	// currents receives the current flag of every watch
+	currents chan bool
+}
+
+func (w *watcher) Watch(current bool) (<-chan *api.MemberEvent, func()) {
+	w.currents <- current
+	return w.events, func() {}
+}
+
+func testWatchMembers(t *testing.T, client, nobody api.LogClient, config *Config) {
+	ctx := context.Background()
+	recvErr := func(client api.LogClient) error {
+		stream, err := client.WatchMembers(ctx, &api.WatchMembersRequest{})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		return err
+	}
+	require.Equal(t, codes.Unimplemented, status.Code(recvErr(client)))
+
+	w := &watcher{
+		events:   make(chan *api.MemberEvent, 1),
+		currents: make(chan bool, 1),
+	}
+	config.MemberWatcher = w
+	require.Equal(t, codes.PermissionDenied, status.Code(recvErr(nobody)))
+
+	stream, err := client.WatchMembers(ctx, &api.WatchMembersRequest{Current: true})
+	require.NoError(t, err)
+	require.True(t, <-w.currents)
+	want := &api.MemberEvent{
+		Type:   api.MemberEventType_MEMBER_FAIL,
+		Server: &api.Server{Id: "1", Zone: "a"},
+		Tags:   map[string]string{"zone": "a"},
+	}
+	w.events <- want
+	got, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, want.Type, got.Type)
+	require.Equal(t, want.Server.Id, got.Server.Id)
+	require.Equal(t, want.Tags, got.Tags)
+
+	// a watcher that fell behind is cut off
+	close(w.events)
+	_, err = stream.Recv()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+// clusterConfig keeps the config it's set to.
+type clusterConfig struct {
+	mu     sync.Mutex
+	config *api.ClusterConfig
+}
+
+func (c *clusterConfig) ClusterConfig() *api.ClusterConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.config
+}
+
+func (c *clusterConfig) SetClusterConfig(config *api.ClusterConfig) (*api.ClusterConfig, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if config.Version != c.config.Version {
+		return nil, api.ErrStaleConfig{Version: config.Version, Current: c.config.Version}
+	}
+	c.config = proto.Clone(config).(*api.ClusterConfig)
+	c.config.Version++
+	return c.config, nil
+}
+
+func (c *clusterConfig) ConfigVersions() map[string]uint64 {
+	return map[string]uint64{"0": c.ClusterConfig().Version}
+}
+
+func testClusterConfig(t *testing.T, client, nobody api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.GetClusterConfig(ctx, &api.GetClusterConfigRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	config.ClusterConfig = &clusterConfig{config: &api.ClusterConfig{}}
+	_, err = nobody.SetClusterConfig(ctx, &api.SetClusterConfigRequest{
+		Config: &api.ClusterConfig{},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.SetClusterConfig(ctx, &api.SetClusterConfigRequest{
+		Config: &api.ClusterConfig{MaxSegmentIndexBytes: 4},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	c, err := client.SetClusterConfig(ctx, &api.SetClusterConfigRequest{
+		Config: &api.ClusterConfig{MaxHeaders: 1},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), c.Version)
+	_, err = client.SetClusterConfig(ctx, &api.SetClusterConfigRequest{
+		Config: &api.ClusterConfig{MaxHeaders: 2},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	res, err := client.GetClusterConfig(ctx, &api.GetClusterConfigRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), res.Config.MaxHeaders)
+	require.Equal(t, map[string]uint64{"0": 1}, res.Versions)
+
+	// the cluster's limit overrides the server's own
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{
+		Value: []byte("hello"),
+		Headers: []*api.Header{
+			{Key: "a", Value: []byte("1")},
+			{Key: "b", Value: []byte("2")},
+		},
+	}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the cluster's acl grants what the policy file doesn't
+	_, err = nobody.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.SetClusterConfig(ctx, &api.SetClusterConfigRequest{
+		Config: &api.ClusterConfig{
+			Version: 1,
+			Acl:     []*api.AclRule{{Subject: "nobody", Action: "produce"}},
+		},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.SetClusterConfig(ctx, &api.SetClusterConfigRequest{
+		Config: &api.ClusterConfig{
+			Version:           1,
+			ProduceQuotaBytes: 20,
+			Acl: []*api.AclRule{
+				{Subject: "nobody", Object: "*", Action: "produce"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	_, err = nobody.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.NoError(t, err)
+
+	// each client has its own quota, which a burst runs out of
+	var n int
+	for ; n < 10; n++ {
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello")},
+		})
+		if err != nil {
+			break
+		}
+	}
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.Greater(t, n, 0)
+}
+
+func testChainReplication(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	config.Chain = &chain.Chain{
+		NodeName: "local",
+		Servers: func() ([]*api.Server, error) {
+			return []*api.Server{
+				{Id: "local", Role: api.Role_ROLE_VOTER, IsLeader: true},
+				{Id: "follower", RpcAddr: "127.0.0.1:1", Role: api.Role_ROLE_VOTER},
+			}, nil
+		},
+	}
+
+	// the head only acknowledges what the tail reported holding
+	produced := make(chan error, 1)
+	go func() {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+			Acks:   api.Acks_ACKS_ALL,
+		})
+		produced <- err
+	}()
+	stream, err := client.Replicate(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ReplicateRequest{
+		Offset:    0,
+		ReplicaId: "follower",
+	}))
+	batch, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), batch.Count)
+	require.NoError(t, stream.Send(&api.ReplicateRequest{Offset: 1}))
+	select {
+	case <-produced:
+		t.Fatal("produce acknowledged before the tail held the record")
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, stream.Send(&api.ReplicateRequest{Offset: 1, ChainTail: 1}))
+	select {
+	case err = <-produced:
+		require.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("produce wasn't acknowledged once the tail held the record")
+	}
+
+	// only the tail serves consistent reads
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      0,
+		Consistency: api.Consistency_CONSISTENCY_LINEARIZABLE,
+	})
+	st := status.Convert(err)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	var tail string
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			tail = info.Metadata["tail"]
+		}
+	}
+	require.Equal(t, "follower", tail)
+}